@@ -0,0 +1,87 @@
+// Command audit searches the audit logs of relays (BIE_AUDIT_FILE) and prints
+// the matching records as JSON lines, or reads the log from stdin without
+// files.
+//
+//	audit -since 2026-10-01 -until 2026-10-07 -identity 203.0.113.7 /var/log/bie/audit.jsonl
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"bie/pkg/audit"
+)
+
+func main() {
+	var filter audit.Filter
+	since := flag.String("since", "", "Records that started at or after this date (2006-01-02) or time (RFC 3339)")
+	until := flag.String("until", "", "Records that started before this time (RFC 3339), or by the end of this date (2006-01-02)")
+	flag.StringVar(&filter.Token, "token", "", "Token of the transfer or its hash")
+	flag.StringVar(&filter.Identity, "identity", "", "Receiver auth token, its hash, receiver IP or sender IP")
+	flag.StringVar(&filter.Event, "event", "", "Only records of this event: register or transfer")
+	count := flag.Bool("count", false, "Print the number of matching records instead")
+	flag.Parse()
+
+	var err error
+	if filter.Since, err = parseTime(*since, false); err != nil {
+		log.Fatalf("Invalid -since: %v", err)
+	}
+	if filter.Until, err = parseTime(*until, true); err != nil {
+		log.Fatalf("Invalid -until: %v", err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	encoder := json.NewEncoder(out)
+	matched := 0
+	emit := func(r audit.Record) error {
+		matched++
+		if *count {
+			return nil
+		}
+		return encoder.Encode(r)
+	}
+
+	if flag.NArg() == 0 {
+		if err := audit.Scan(os.Stdin, filter, emit); err != nil {
+			log.Fatalf("Failed to read stdin: %v", err)
+		}
+	}
+	for _, path := range flag.Args() {
+		if err := scanFile(path, filter, emit); err != nil {
+			log.Fatalf("Failed to read %s: %v", path, err)
+		}
+	}
+	if *count {
+		fmt.Fprintln(out, matched)
+	}
+}
+
+func scanFile(path string, filter audit.Filter, fn func(audit.Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return audit.Scan(file, filter, fn)
+}
+
+// parseTime reads a date or RFC 3339 time, zero for empty. endOfDay moves a
+// date to the start of the next day, so it includes the whole date.
+func parseTime(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -2,110 +2,105 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"net/http"
 	"os"
 	"time"
 
-	"bie/pkg/biecy"
-	"bie/pkg/biewire"
-	"bie/pkg/osserver"
+	"bie/pkg/bietrace"
+	"bie/pkg/client"
+	"bie/pkg/transport"
 
 	"github.com/alecthomas/kong"
 	"github.com/caarlos0/env/v11"
-
-	"github.com/xtaci/smux"
 )
 
 type Config struct {
 	ServerAddress string `env:"BIE_SERVER" envDefault:"bie.mlops.ninja:80"`
 	Port          int    `env:"BIE_PORT" envDefault:"443"`
 	Domain        string `env:"BIE_DOMAIN" envDefault:"bie.mlops.ninja"`
+	// Validity of the one-shot certificate the sender has to trust
+	CertLifetime time.Duration `env:"BIE_CERT_LIFETIME" envDefault:"30m"`
+	// How to reach the relay: "auto" tries "quic" and falls back to "tls".
+	// "tls" and "websocket" honour HTTPS_PROXY
+	Transport string `env:"BIE_TRANSPORT" envDefault:"tls"`
+	// smux tuning of the "tls" and "websocket" transports, negotiated with
+	// the relay, which caps it. Unset keeps smux's defaults.
+	SmuxVersion       int           `env:"BIE_SMUX_VERSION"`
+	SmuxReceiveBuffer int           `env:"BIE_SMUX_RECEIVE_BUFFER"`
+	SmuxStreamBuffer  int           `env:"BIE_SMUX_STREAM_BUFFER"`
+	SmuxFrameSize     int           `env:"BIE_SMUX_FRAME_SIZE"`
+	SmuxKeepAlive     time.Duration `env:"BIE_SMUX_KEEPALIVE"`
+	// Identifies the receiver to relays that keep an audit log
+	AuthToken string `env:"BIE_AUTH_TOKEN"`
+	// Spans are exported over OTLP/HTTP to this endpoint, empty disables
+	// tracing
+	OTLPEndpoint string `env:"BIE_OTLP_ENDPOINT"`
 }
 
 type GetCmd struct {
 	NewFilePath string `arg:"" name:"new-file-path" help:"Path to save the file to." type:"path"`
+	Code        bool   `name:"code" help:"Use a short transfer code instead of a URL."`
+	Encrypt     bool   `name:"encrypt" help:"Encrypt the file end to end with a key carried in the URL fragment."`
+	RelayTLS    bool   `name:"relay-tls" help:"Let the relay terminate TLS, so senders need no pin. The relay can read the file unless --encrypt is used."`
+	Parallel    int    `name:"parallel" help:"Let bie send upload the file in chunks over up to this many connections."`
+	NoCompress  bool   `name:"no-compress" help:"Do not let bie send compress the file."`
 }
 
-func (c *GetCmd) Run() error {
+func (c *GetCmd) Run() (err error) {
 	cfg, err := env.ParseAs[Config]()
 	if err != nil {
 		log.Fatalf("Failed to parse environment variables: %v", err)
 	}
 
 	targetFile := c.NewFilePath
-
-	// 1. Connect to relay with TLS
-	tlsConn, err := tls.DialWithDialer(
-		&net.Dialer{
-			Timeout: 30 * time.Second,
-		},
-		"tcp",
-		cfg.ServerAddress,
-		&tls.Config{
-			ServerName: cfg.Domain, // Required for SNI and certificate validation
-		},
-	)
-	if err != nil {
-		return fmt.Errorf("TLS connection failed: %v", err)
+	if c.Code && c.Encrypt {
+		return fmt.Errorf("--encrypt needs a URL to carry the key, use it without --code")
 	}
-
-	// 2. Create smux session
-	session, err := smux.Client(tlsConn, nil)
-	if err != nil {
-		return fmt.Errorf("Failed to create smux session: %v", err)
+	if c.Code && c.RelayTLS {
+		return fmt.Errorf("--code needs end-to-end TLS, use it without --relay-tls")
 	}
-
-	// 3. Create auth stream
-	authStream, err := session.OpenStream()
-	if err != nil {
-		return fmt.Errorf("Failed to open auth stream: %v", err)
+	if c.Code && c.Parallel > 1 {
+		return fmt.Errorf("--code pairs a single connection, use --parallel without it")
 	}
-	defer authStream.Close()
 
-	// 2. Send auth request
-	if err := sendAuthRequest(authStream, "", "get"); err != nil {
-		session.Close()
-		return fmt.Errorf("Failed to send request: %v", err)
-	}
+	ctx, endTrace := startTrace(context.Background(), cfg, "bie get")
+	defer func() { endTrace(err) }()
 
-	// 3. Read token from server
-	var clientResponse biewire.ClientResponse
-	if biewire.ReceiveJSON(authStream, &clientResponse); err != nil {
-		session.Close()
-		return fmt.Errorf("Failed to read response: %v", err)
+	opts := cfg.clientOptions()
+	opts.Code = c.Code
+	opts.Encrypt = c.Encrypt
+	opts.RelayTLS = c.RelayTLS
+	opts.Parallel = c.Parallel
+	if c.NoCompress {
+		opts.Compression = client.CompressOff
 	}
 
-	bieDomain := clientResponse.Token + "." + cfg.Domain
-
-	// 5. Generate our own certificate for the server role
-	caCert, caKey := biecy.GenerateMinimalCA()
-	certPEM, keyPEM := biecy.GenerateMinimalServerCert(caCert, caKey, bieDomain)
-
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	receiver, err := client.Receive(ctx, opts)
 	if err != nil {
-		session.Close()
-		return fmt.Errorf("Failed to load certificate: %v", err)
-	}
-
-	// Create TLS config for our server
-	serverTLSConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+		return err
 	}
 
 	// Creating TUI
 	curlCmd := fmt.Sprintf(
-		"curl -X POST -k -F 'file=@%s' --cacert <(echo '%s') https://%s:%d/file",
+		"curl -k --pinnedpubkey '%s' -F 'file=@%s' %s",
+		receiver.Pin,
 		targetFile,
-		string(certPEM),
-		bieDomain,
-		cfg.Port,
+		receiver.URL,
 	)
-	fmt.Println(curlCmd)
+	if c.Code {
+		fmt.Printf("bie send --code %s %s\n", receiver.Code, targetFile)
+	} else if c.Encrypt {
+		fmt.Printf("bie send %s '%s'\n", targetFile, receiver.ShareURL())
+	} else if c.RelayTLS {
+		fmt.Printf("curl -F 'file=@%s' %s\n", targetFile, receiver.URL)
+		fmt.Printf("bie send %s '%s'\n", targetFile, receiver.ShareURL())
+	} else {
+		// bie send learns parallelism and compression from the fragment,
+		// curl sends over a single connection as is
+		fmt.Println(curlCmd)
+		fmt.Printf("bie send %s '%s'\n", targetFile, receiver.ShareURL())
+	}
 	// p := tea.NewProgram(Model{FilePath: targetFile, Command: curlCmd, FileSize: 0, Uploaded: 0} /*tea.WithAltScreen()*/)
 
 	// go func() {
@@ -115,67 +110,57 @@ func (c *GetCmd) Run() error {
 	// 	os.Exit(0)
 	// }()
 
-	// 6. Accepting incoming stream from relay
-	serverStream, err := session.AcceptStream()
-	if err != nil {
-		session.Close()
-		return fmt.Errorf("Failed to accept stream: %v", err)
-	}
-
-	serverTLSConn := tls.Server(serverStream, serverTLSConfig)
-	if err := serverTLSConn.Handshake(); err != nil {
-		session.Close()
-		return fmt.Errorf("Server TLS handshake failed: %v", err)
-	}
-
-	// Mux for oneshot server
-	mux := http.NewServeMux()
-	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		file, _, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, "Failed to read file", http.StatusBadRequest)
-			return
-		}
-		defer file.Close()
-		out, err := os.Create(targetFile)
-		if err != nil {
-			http.Error(w, "Failed to create file", http.StatusInternalServerError)
-			return
-		}
-		defer out.Close()
-		io.Copy(out, file)
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "File %s successfully transfered\n", targetFile)
-	})
-
-	// Server with TLS
-	server := osserver.NewOneShotServer(serverTLSConn, mux)
-	if err := server.Serve(context.Background()); err != nil {
-		return fmt.Errorf("Server error: %v", err)
+	if err := receiver.Save(ctx, targetFile); err != nil {
+		return fmt.Errorf("Transfer failed: %v", err)
 	}
 
 	// p.Quit()
 	return nil
 }
 
-// Send request to server
-func sendAuthRequest(conn io.Writer, authToken string, intention string) error {
-	// Create request
-	req := biewire.ClientRequest{
-		Intention: intention,
-		AuthToken: authToken,
+// startTrace exports spans to cfg.OTLPEndpoint if set and starts the span of
+// command. Its trace ID is printed, to find the relay's logs and spans of a
+// failed transfer. endTrace flushes the spans, marking the command failed
+// with err.
+func startTrace(ctx context.Context, cfg Config, command string) (_ context.Context, endTrace func(err error)) {
+	shutdown, err := bietrace.Setup(ctx, bietrace.Config{Endpoint: cfg.OTLPEndpoint, ServiceName: "bie"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Tracing disabled: %v\n", err)
+	}
+	ctx, span := bietrace.Tracer().Start(ctx, command)
+	if id := bietrace.TraceID(ctx); id != "" {
+		fmt.Fprintf(os.Stderr, "Trace ID: %s\n", id)
+	}
+	return ctx, func(err error) {
+		bietrace.End(span, err)
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown(flushCtx)
 	}
+}
 
-	return biewire.SendJSON(conn, req)
+func (cfg Config) clientOptions() client.Options {
+	return client.Options{
+		ServerAddress: cfg.ServerAddress,
+		Domain:        cfg.Domain,
+		Port:          cfg.Port,
+		CertLifetime:  cfg.CertLifetime,
+		Transport:     cfg.Transport,
+		AuthToken:     cfg.AuthToken,
+		Smux: transport.SmuxParams{
+			Version:           cfg.SmuxVersion,
+			MaxReceiveBuffer:  cfg.SmuxReceiveBuffer,
+			MaxStreamBuffer:   cfg.SmuxStreamBuffer,
+			MaxFrameSize:      cfg.SmuxFrameSize,
+			KeepAliveInterval: cfg.SmuxKeepAlive,
+		},
+	}
 }
 
 var CLI struct {
-	Get GetCmd `cmd:"" help:"Get a file."`
+	Get    GetCmd    `cmd:"" help:"Get a file."`
+	Send   SendCmd   `cmd:"" help:"Send a file."`
+	Tunnel TunnelCmd `cmd:"" help:"Expose a local TCP service through the relay."`
 }
 
 func main() {
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"bie/pkg/client"
+
+	"github.com/caarlos0/env/v11"
+)
+
+type SendCmd struct {
+	FilePath string `arg:"" name:"file" help:"Path of the file to send." type:"existingfile"`
+	URL      string `arg:"" name:"url" optional:"" help:"Upload URL printed by 'bie get', including its fragment if any."`
+	Pin      string `name:"pin" help:"Public key pin of the receiver (sha256//...), if not in the URL. Without one the relay's certificate is verified."`
+	Code     string `name:"code" help:"Transfer code printed by 'bie get --code'."`
+	Parallel int    `name:"parallel" help:"Most connections to upload over when the receiver allows several, 1 sends over one."`
+	Compress string `name:"compress" enum:"auto,zstd,gzip,off" default:"auto" help:"Compress with zstd or gzip if the receiver supports it, auto skips files that do not compress."`
+}
+
+func (c *SendCmd) Run() (err error) {
+	if c.Code == "" && c.URL == "" {
+		return errors.New("Either --code or the URL is required")
+	}
+
+	cfg, err := env.ParseAs[Config]()
+	if err != nil {
+		return fmt.Errorf("Failed to parse environment variables: %v", err)
+	}
+
+	file, err := os.Open(c.FilePath)
+	if err != nil {
+		return fmt.Errorf("Failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	opts := cfg.clientOptions()
+	opts.Pin = c.Pin
+	opts.Name = filepath.Base(c.FilePath)
+	opts.Parallel = c.Parallel
+	opts.Compression = c.Compress
+	if info, err := file.Stat(); err == nil {
+		opts.Size = info.Size()
+	}
+
+	ctx, endTrace := startTrace(context.Background(), cfg, "bie send")
+	defer func() { endTrace(err) }()
+
+	if c.Code != "" {
+		err = client.SendCode(ctx, c.Code, file, opts)
+	} else {
+		err = client.Send(ctx, c.URL, file, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("Transfer failed: %v", err)
+	}
+
+	fmt.Printf("File %s successfully transferred\n", c.FilePath)
+	return nil
+}
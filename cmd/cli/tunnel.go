@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"bie/pkg/client"
+
+	"github.com/caarlos0/env/v11"
+)
+
+type TunnelCmd struct {
+	LocalAddr     string        `arg:"" name:"local-addr" help:"Local TCP address to expose, host:port."`
+	CertLifetime  time.Duration `name:"cert-lifetime" default:"24h" help:"Validity of the certificate clients trust by pin."`
+	MaxConcurrent int           `name:"max-concurrent" help:"Maximum simultaneous connections, 0 leaves it to the relay."`
+	MaxTotal      int           `name:"max-total" help:"Maximum connections in total, 0 leaves it to the relay."`
+	RelayTLS      bool          `name:"relay-tls" help:"Let the relay terminate TLS, so clients need no pin. The relay sees the traffic."`
+}
+
+func (c *TunnelCmd) Run() (err error) {
+	cfg, err := env.ParseAs[Config]()
+	if err != nil {
+		return fmt.Errorf("Failed to parse environment variables: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, endTrace := startTrace(ctx, cfg, "bie tunnel")
+	defer func() { endTrace(err) }()
+
+	opts := cfg.clientOptions()
+	opts.CertLifetime = c.CertLifetime
+	opts.MaxConcurrent = c.MaxConcurrent
+	opts.MaxTotal = c.MaxTotal
+	opts.RelayTLS = c.RelayTLS
+	opts.TunnelError = func(err error) {
+		fmt.Fprintf(os.Stderr, "Connection dropped: %v\n", err)
+	}
+
+	tunnel, err := client.OpenTunnel(ctx, c.LocalAddr, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Forwarding %s to %s\n", tunnel.URL, c.LocalAddr)
+	if tunnel.Pin != "" {
+		fmt.Printf("Public key pin: %s\n", tunnel.Pin)
+	}
+
+	if err := tunnel.Wait(); err != nil {
+		return fmt.Errorf("Tunnel failed: %v", err)
+	}
+	return nil
+}
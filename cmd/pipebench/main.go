@@ -0,0 +1,173 @@
+// Command pipebench compares the relay's ways of piping a sender to a
+// receiver on loopback, in bytes per second and CPU time per GiB:
+//
+//	smux    sender TCP to a smux stream, the relay's path today
+//	copy    TCP to TCP through a user space buffer
+//	splice  TCP to TCP with splice(2), for direct modes without a mux
+//
+// CPU time is the whole process's, so it includes sending and discarding
+// the bytes at both ends, which costs the same in every mode.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"bie/pkg/splice"
+
+	"github.com/xtaci/smux"
+)
+
+func main() {
+	size := flag.Int64("size", 4<<30, "Bytes to pipe in each mode")
+	flag.Parse()
+
+	modes := []struct {
+		name string
+		pipe pipeFunc
+	}{
+		{"smux", pipeSmux},
+		{"copy", pipeDirect(copyUserSpace)},
+		{"splice", pipeDirect(func(dst, src net.Conn) (int64, error) {
+			return splice.Copy(dst, src, nil)
+		})},
+	}
+
+	fmt.Printf("Piping %d MiB per mode\n", *size>>20)
+	for _, mode := range modes {
+		elapsed, cpu, err := measure(*size, mode.pipe)
+		if err != nil {
+			log.Fatalf("%s: %v", mode.name, err)
+		}
+		gib := float64(*size) / (1 << 30)
+		fmt.Printf("%-7s %9.1f MiB/s  %6.2f s CPU/GiB\n",
+			mode.name, float64(*size)/(1<<20)/elapsed.Seconds(), cpu.Seconds()/gib)
+	}
+}
+
+// pipeFunc starts piping src, the sender's connection on the relay, into
+// toReceiver, the relay's connection to the receiver. The returned function
+// reads size bytes at receiver, the other end of toReceiver.
+type pipeFunc func(src, toReceiver, receiver net.Conn, size int64) (wait func() error)
+
+// measure sends size bytes from a sender through the relay's pipe to a
+// receiver and returns the wall and CPU time it took
+func measure(size int64, pipe pipeFunc) (time.Duration, time.Duration, error) {
+	relayLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer relayLn.Close()
+	receiverLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer receiverLn.Close()
+
+	sender, err := net.Dial("tcp", relayLn.Addr().String())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer sender.Close()
+	src, err := relayLn.Accept()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+	toReceiver, err := net.Dial("tcp", receiverLn.Addr().String())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer toReceiver.Close()
+	receiver, err := receiverLn.Accept()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer receiver.Close()
+
+	startCPU := cpuTime()
+	start := time.Now()
+	wait := pipe(src, toReceiver, receiver, size)
+	go func() {
+		io.CopyN(sender, zeros{}, size)
+		sender.Close()
+	}()
+	if err := wait(); err != nil {
+		return 0, 0, err
+	}
+	return time.Since(start), cpuTime() - startCPU, nil
+}
+
+// pipeDirect pipes with copy from the sender's connection straight into the
+// receiver's
+func pipeDirect(copy func(dst, src net.Conn) (int64, error)) pipeFunc {
+	return func(src, toReceiver, receiver net.Conn, size int64) func() error {
+		go func() {
+			copy(toReceiver, src)
+			toReceiver.Close()
+		}()
+		return func() error { return discard(receiver, size) }
+	}
+}
+
+// pipeSmux pipes the sender's connection into a stream of a smux session
+// with the receiver, like the relay does
+func pipeSmux(src, toReceiver, receiver net.Conn, size int64) func() error {
+	return func() error {
+		session, err := smux.Client(toReceiver, nil)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		peer, err := smux.Server(receiver, nil)
+		if err != nil {
+			return err
+		}
+		defer peer.Close()
+
+		stream, err := session.OpenStream()
+		if err != nil {
+			return err
+		}
+		go func() {
+			io.Copy(stream, src)
+			stream.Close()
+		}()
+		received, err := peer.AcceptStream()
+		if err != nil {
+			return err
+		}
+		return discard(received, size)
+	}
+}
+
+// discard reads size bytes from conn, the pipe is done once they arrived
+func discard(conn net.Conn, size int64) error {
+	_, err := io.CopyN(io.Discard, conn, size)
+	return err
+}
+
+// copyUserSpace hides the connections' ReadFrom and WriteTo, which would
+// splice on their own, so every byte goes through a buffer
+func copyUserSpace(dst, src net.Conn) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, 32<<10))
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// cpuTime returns the user and system time the process used so far
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -1,28 +1,44 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base32"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"bie/pkg/audit"
 	"bie/pkg/bielog"
+	"bie/pkg/bietrace"
 	"bie/pkg/biewire"
 	"bie/pkg/certs"
+	"bie/pkg/handoff"
+	"bie/pkg/health"
+	"bie/pkg/osserver"
+	"bie/pkg/transport"
 
 	"github.com/caarlos0/env/v11"
-	"github.com/xtaci/smux"
+	"github.com/quic-go/quic-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Relay server settings
@@ -39,46 +55,337 @@ type Config struct {
 	ShardID       string `env:"BIE_SHARD_ID" envDefault:"01"`
 	Email         string `env:"BIE_EMAIL" envDefault:"admin@mlops.ninja"`
 	// Certs
+	// Certificate provider: "fs" (certbot managed files) or "acme"
+	CertProvider string `env:"BIE_CERT_PROVIDER" envDefault:"fs"`
 	// Certificate paths
 	CertFile string `env:"BIE_CERT_FILE" envDefault:"/etc/letsencrypt/live/bie.mlops.ninja/fullchain.pem"`
 	KeyFile  string `env:"BIE_KEY_FILE" envDefault:"/etc/letsencrypt/live/bie.mlops.ninja/privkey.pem"`
+	// Additional domains served by the relay, picked by SNI. Each one uses
+	// CertDir/<domain>/fullchain.pem and privkey.pem, unless its provider is
+	// set to "acme" like "vanity.example:acme"
+	ExtraDomains       []string          `env:"BIE_EXTRA_DOMAINS"`
+	ExtraCertProviders map[string]string `env:"BIE_EXTRA_CERT_PROVIDERS"`
+	CertDir            string            `env:"BIE_CERT_DIR" envDefault:"/etc/letsencrypt/live"`
+	// ACME
+	ACMEDirectoryURL string        `env:"BIE_ACME_DIRECTORY_URL"`
+	ACMECARoot       string        `env:"BIE_ACME_CA_ROOT"`
+	ACMECacheDir     string        `env:"BIE_ACME_CACHE_DIR" envDefault:"/var/lib/bie/acme"`
+	ACMEHTTPAddr     string        `env:"BIE_ACME_HTTP_ADDR" envDefault:":80"`
+	ACMERenewBefore  time.Duration `env:"BIE_ACME_RENEW_BEFORE" envDefault:"720h"`
 	// Logger
 	LogType  string `env:"BIE_LOG_TYPE" envDefault:"text"`
 	LogLevel string `env:"BIE_LOG_LEVEL" envDefault:"info"`
+	// Any of stdout, stderr, file, syslog and journald
+	LogSinks []string `env:"BIE_LOG_SINKS" envDefault:"stdout"`
+	// The file sink is rotated past a size or age, 0 disables either
+	LogFile       string        `env:"BIE_LOG_FILE" envDefault:"/var/log/bie/relay.log"`
+	LogMaxSize    int64         `env:"BIE_LOG_MAX_SIZE" envDefault:"104857600"`
+	LogMaxAge     time.Duration `env:"BIE_LOG_MAX_AGE" envDefault:"0"`
+	LogMaxBackups int           `env:"BIE_LOG_MAX_BACKUPS" envDefault:"10"`
+	// Remote syslog like udp://host:514, empty is the local daemon
+	LogSyslogAddr string `env:"BIE_LOG_SYSLOG_ADDR"`
+	// Messages starting with these are logged BIE_LOG_SAMPLE_FIRST times per
+	// interval and then every BIE_LOG_SAMPLE_THEREAFTER-th, so scanners
+	// probing for tokens do not flood the log. 0 interval disables it.
+	LogSampleMessages   []string      `env:"BIE_LOG_SAMPLE_MESSAGES" envDefault:"No receiver found,Invalid TLS handshake"`
+	LogSampleInterval   time.Duration `env:"BIE_LOG_SAMPLE_INTERVAL" envDefault:"1m"`
+	LogSampleFirst      int           `env:"BIE_LOG_SAMPLE_FIRST" envDefault:"10"`
+	LogSampleThereafter int           `env:"BIE_LOG_SAMPLE_THEREAFTER" envDefault:"100"`
+	// Upgrades
+	// Unix socket used to hand listeners over to a new relay process, empty disables it
+	UpgradeSocket string        `env:"BIE_UPGRADE_SOCKET"`
+	DrainTimeout  time.Duration `env:"BIE_DRAIN_TIMEOUT" envDefault:"1h"`
+	// Limits of registrations serving many senders (tunnels, file serving),
+	// receivers may ask for lower ones. 0 is unlimited.
+	MaxConcurrentSenders int `env:"BIE_MAX_CONCURRENT_SENDERS" envDefault:"32"`
+	MaxSendersPerToken   int `env:"BIE_MAX_SENDERS_PER_TOKEN" envDefault:"0"`
+	// Let receivers opt into the relay terminating TLS of their senders,
+	// needs a wildcard certificate for the domain. ACME cannot issue one.
+	RelayTLS bool `env:"BIE_RELAY_TLS" envDefault:"false"`
+	// Accept QUIC receivers on the receiver port over UDP. They cannot be
+	// drained on upgrades, they are dropped and resume with the new relay.
+	QUIC bool `env:"BIE_QUIC" envDefault:"false"`
+	// How long the token of a disconnected receiver stays reserved for it to
+	// reconnect with its resume secret
+	ResumeGrace time.Duration `env:"BIE_RESUME_GRACE" envDefault:"2m"`
+	// smux sessions of TLS and WebSocket receivers. Receivers negotiating
+	// parameters get at most these, the others smux version 1 with them.
+	SmuxVersion       int           `env:"BIE_SMUX_VERSION" envDefault:"2"`
+	SmuxReceiveBuffer int           `env:"BIE_SMUX_RECEIVE_BUFFER" envDefault:"33554432"`
+	SmuxStreamBuffer  int           `env:"BIE_SMUX_STREAM_BUFFER" envDefault:"16777216"`
+	SmuxFrameSize     int           `env:"BIE_SMUX_FRAME_SIZE" envDefault:"32768"`
+	SmuxKeepAlive     time.Duration `env:"BIE_SMUX_KEEPALIVE" envDefault:"10s"`
+	// Senders piped to receivers are dropped after this long without a byte
+	// either way, or this long in total. 0 is unlimited.
+	PipeIdleTimeout time.Duration `env:"BIE_PIPE_IDLE_TIMEOUT" envDefault:"5m"`
+	PipeTimeout     time.Duration `env:"BIE_PIPE_TIMEOUT" envDefault:"0"`
+	// Registrations and transfers are appended to this file as JSON lines,
+	// empty disables the audit log
+	AuditFile string `env:"BIE_AUDIT_FILE"`
+	// Spans are exported over OTLP/HTTP to this endpoint, empty disables
+	// tracing. The ratio applies to traces not started by a receiver.
+	OTLPEndpoint     string  `env:"BIE_OTLP_ENDPOINT"`
+	TraceSampleRatio float64 `env:"BIE_TRACE_SAMPLE_RATIO" envDefault:"1"`
+	// Admin
+	// Port serving /healthz and /readyz for liveness and readiness probes, 0
+	// disables it. Checks taking longer than the timeout fail.
+	AdminPort     int           `env:"BIE_ADMIN_PORT" envDefault:"0"`
+	HealthTimeout time.Duration `env:"BIE_HEALTH_TIMEOUT" envDefault:"5s"`
 }
 
-// Store active connections (Token → Connection)
+func (cfg Config) pipeTimeouts() transport.PipeTimeouts {
+	return transport.PipeTimeouts{Idle: cfg.PipeIdleTimeout, Total: cfg.PipeTimeout}
+}
+
+func (cfg Config) logConfig() bielog.Config {
+	return bielog.Config{
+		Type:       cfg.LogType,
+		Level:      cfg.LogLevel,
+		Sinks:      cfg.LogSinks,
+		File:       cfg.LogFile,
+		MaxSize:    cfg.LogMaxSize,
+		MaxAge:     cfg.LogMaxAge,
+		MaxBackups: cfg.LogMaxBackups,
+		SyslogAddr: cfg.LogSyslogAddr,
+		Tag:        "bie-relay",
+		Sampling: bielog.Sampling{
+			Interval:   cfg.LogSampleInterval,
+			First:      cfg.LogSampleFirst,
+			Thereafter: cfg.LogSampleThereafter,
+			Messages:   cfg.LogSampleMessages,
+		},
+	}
+}
+
+func (cfg Config) smuxParams() transport.SmuxParams {
+	return transport.SmuxParams{
+		Version:           cfg.SmuxVersion,
+		MaxReceiveBuffer:  cfg.SmuxReceiveBuffer,
+		MaxStreamBuffer:   cfg.SmuxStreamBuffer,
+		MaxFrameSize:      cfg.SmuxFrameSize,
+		KeepAliveInterval: cfg.SmuxKeepAlive,
+	}
+}
+
+// Store one-shot receivers (Token → Session), tunnels that get a new
+// stream per sender (Token → Tunnel), short nameplates of transfer codes
+// (Nameplate → Token), tokens whose senders' TLS the relay terminates and
+// registrations receivers can resume (Token → Reservation)
 var connectionStore = struct {
 	sync.RWMutex
-	connections map[string]net.Conn
-}{connections: make(map[string]net.Conn)}
+	receivers    map[string]transport.Session
+	tunnels      map[string]*tunnel
+	nameplates   map[string]string
+	relayTLS     map[string]bool
+	reservations map[string]*reservation
+}{
+	receivers:    make(map[string]transport.Session),
+	tunnels:      make(map[string]*tunnel),
+	nameplates:   make(map[string]string),
+	relayTLS:     make(map[string]bool),
+	reservations: make(map[string]*reservation),
+}
+
+// A registration the receiver can take over from a new connection with its
+// resume secret. It outlives the receiver's session by Config.ResumeGrace,
+// until then the token is not reused. Guarded by connectionStore.
+type reservation struct {
+	secret    string
+	nameplate string
+	// Kept across reconnects so limits keep counting
+	tunnel *tunnel
+	// Current receiver session, nil while disconnected
+	session transport.Session
+	expiry  *time.Timer
+	// Who registered, for the audit log
+	receiver  audit.Receiver
+	intention string
+	// Span of the registration, senders join its trace
+	trace trace.SpanContext
+}
+
+// A registration accepting many senders, each over a new stream. Counters
+// are guarded by connectionStore.
+type tunnel struct {
+	session transport.Session
+	// Limits, 0 is unlimited
+	maxConcurrent int
+	maxTotal      int
+	// Senders currently connected and connected so far
+	active int
+	total  int
+}
+
+// Registered receiver sessions, waited for while draining after a handoff
+var activeSessions sync.WaitGroup
+
+// Set once the relay stops taking new receivers, i.e. it handed its
+// listeners off or is shutting down
+var draining atomic.Bool
+
+// State of the accept loops by listener name, reported by health checks
+var listenerStore = struct {
+	sync.RWMutex
+	listeners map[string]listenerState
+}{
+	listeners: make(map[string]listenerState),
+}
+
+type listenerState struct {
+	Addr      string `json:"addr"`
+	Accepting bool   `json:"accepting"`
+	// Why the loop stopped, empty when the listener was closed
+	Error string `json:"error,omitempty"`
+}
+
+// Audit log of registrations and transfers, set up from Config.AuditFile
+var auditLog = audit.Discard
+
+// Appends record to the audit log, failures are logged
+func writeAudit(ctx context.Context, record audit.Record) {
+	if err := auditLog.Write(record); err != nil {
+		bielog.FromCtx(ctx).ErrorContext(ctx, "Failed to write audit record", "err", err)
+	}
+}
+
+// Starts the audit record of a sender of token, connectionStore must be
+// locked
+func newTransferRecord(token string, sender net.Conn, cfg Config) audit.Record {
+	record := audit.Record{
+		Event:     audit.EventTransfer,
+		TokenHash: audit.Hash(token),
+		Shard:     cfg.ShardID,
+		SenderIP:  hostOf(sender.RemoteAddr()),
+		Start:     time.Now(),
+	}
+	if res, ok := connectionStore.reservations[token]; ok {
+		record.Receiver = res.receiver
+		record.Intention = res.intention
+	}
+	return record
+}
+
+// Completes the audit record of a transfer with how its pipe went
+func auditTransfer(ctx context.Context, record audit.Record, summary transport.PipeSummary) {
+	record.End = time.Now()
+	record.BytesToReceiver = summary.AToB
+	record.BytesToSender = summary.BToA
+	switch {
+	case summary.Err == nil:
+		record.Outcome = audit.OutcomeCompleted
+	case errors.Is(summary.Err, transport.ErrIdleTimeout):
+		record.Outcome = audit.OutcomeIdleTimeout
+	case errors.Is(summary.Err, transport.ErrPipeTimeout):
+		record.Outcome = audit.OutcomeTimeout
+	default:
+		record.Outcome = audit.OutcomeFailed
+	}
+	if summary.Err != nil {
+		record.Error = summary.Err.Error()
+	}
+	writeAudit(ctx, record)
+}
+
+// Completes the audit record of a sender that was turned away, and marks
+// the sender's span failed
+func auditRefusal(ctx context.Context, record audit.Record, reason string) {
+	trace.SpanFromContext(ctx).SetStatus(codes.Error, reason)
+	record.End = time.Now()
+	record.Outcome = audit.OutcomeRefused
+	record.Error = reason
+	writeAudit(ctx, record)
+}
+
+// Starts the span of a sender of token that arrived at start, connectionStore
+// must be locked. Senders without trace context of their own join the trace
+// of the receiver's registration, the others link to it.
+func startSenderSpan(ctx context.Context, token string, start time.Time) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindServer), trace.WithTimestamp(start)}
+	if res, ok := connectionStore.reservations[token]; ok && res.trace.IsValid() {
+		if trace.SpanContextFromContext(ctx).IsValid() {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: res.trace}))
+		} else {
+			ctx = trace.ContextWithRemoteSpanContext(ctx, res.trace)
+		}
+	}
+	return bietrace.Tracer().Start(ctx, "relay.sender", opts...)
+}
+
+// Records the lookup of a sender's receiver, from start until now
+func traceLookup(ctx context.Context, start time.Time) {
+	_, span := bietrace.Tracer().Start(ctx, "relay.lookup", trace.WithTimestamp(start))
+	span.End()
+}
+
+// Pipes a sender to its receiver in a span
+func pipeSender(ctx context.Context, sender, receiver net.Conn, cfg Config) transport.PipeSummary {
+	_, span := bietrace.Tracer().Start(ctx, "relay.pipe")
+	summary := transport.Pipe(sender, receiver, cfg.pipeTimeouts())
+	span.SetAttributes(
+		attribute.Int64("bie.bytes_forward", summary.AToB),
+		attribute.Int64("bie.bytes_back", summary.BToA),
+	)
+	bietrace.End(span, summary.Err)
+	return summary
+}
+
+// IP of addr without the port
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
 
 // Generates a secure random `XID` token
 func generateSecureToken() string {
 	randomBytes := make([]byte, tokenSize)
 	_, err := rand.Read(randomBytes)
 	if err != nil {
-		log.Fatal("Failed to generate secure token:", err)
+		panic("failed to generate secure token: " + err.Error())
 	}
 	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes) // Base32 encoding
 }
 
-// Handles receiver registration
-func registerReceiver(conn net.Conn, cfg Config, certProvider certs.Provider) {
+// Logs only this much of a token's XID, enough to tell registrations apart.
+// The whole token lets anyone reach the receiver.
+const loggedTokenChars = 8
+
+// Attribute of token for logs, its shard and the start of its XID
+func tokenAttr(token string) slog.Attr {
+	shard, xid, _ := strings.Cut(token, "-")
+	return slog.String("token", shard+"-"+xid[:min(len(xid), loggedTokenChars)])
+}
+
+// Handles receiver registration over a stream transport
+func registerReceiver(ctx context.Context, conn net.Conn, cfg Config, certProvider certs.Provider, predecessor *handoff.Predecessor) {
 	defer conn.Close()
 
 	// 1. smux servcer
-	session, err := smux.Server(conn, nil)
+	session, err := transport.SmuxServer(conn, cfg.smuxParams())
 	if err != nil {
-		log.Println("Failed to create smux session:", err)
+		bielog.FromCtx(ctx).WarnContext(ctx, "Failed to create smux session", "remote_addr", conn.RemoteAddr().String(), "err", err)
 		return
 	}
+	serveReceiver(ctx, session, cfg, certProvider, predecessor)
+}
+
+// Handles receiver registration over its multiplexed session, until the
+// receiver disconnects. Registrations to resume that are unknown here are
+// taken over from predecessor, if any.
+func serveReceiver(ctx context.Context, session transport.Session, cfg Config, certProvider certs.Provider, predecessor *handoff.Predecessor) {
+	activeSessions.Add(1)
+	defer activeSessions.Done()
 	defer session.Close()
 
+	logger := bielog.FromCtx(ctx).With("remote_addr", session.RemoteAddr().String())
+	ctx = bielog.CtxWithLogger(ctx, logger)
+
 	// 2. Open auth stream
 	authStream, err := session.AcceptStream()
 	if err != nil {
-		log.Println("Failed to accept auth stream:", err)
+		logger.WarnContext(ctx, "Failed to accept auth stream", "err", err)
 		return
 	}
 	defer authStream.Close()
@@ -86,36 +393,153 @@ func registerReceiver(conn net.Conn, cfg Config, certProvider certs.Provider) {
 	// 3. Read auth request
 	var req biewire.ClientRequest
 	if err := biewire.ReceiveJSON(authStream, &req); err != nil {
-		log.Println("Failed to read JSON request:", err)
+		logger.WarnContext(ctx, "Failed to read JSON request", "err", err)
+		return
+	}
+
+	// Our spans join the client's trace
+	ctx = bietrace.Extract(ctx, req.TraceParent)
+
+	// Senders with a transfer code come in through the receiver port
+	if req.Intention == biewire.IntentionSend {
+		joinReceiver(ctx, authStream, req.Nameplate, cfg)
 		return
 	}
 
-	// Generate `SHARD-ID-XID`
-	shardID := cfg.ShardID
-	xid := generateSecureToken()
-	token := strings.ToLower(fmt.Sprintf("%s-%s", shardID, xid))
+	ctx, span := bietrace.Tracer().Start(ctx, "relay.register",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("bie.intention", req.Intention),
+			attribute.Bool("bie.code", req.Code),
+			attribute.Bool("bie.relay_tls", req.RelayTLS),
+			attribute.Bool("bie.resume", req.ResumeToken != ""),
+		))
+	// The span covers the registration, refusals end it with their reason
+	var refusal error
+	endRegistration := sync.OnceFunc(func() { bietrace.End(span, refusal) })
+	defer endRegistration()
+
+	if req.RelayTLS && !cfg.RelayTLS {
+		refusal = errors.New("relay-terminated TLS is disabled")
+		biewire.SendJSON(authStream, biewire.ClientResponse{Error: refusal.Error()})
+		return
+	}
+	if req.RelayTLS && req.Code {
+		// The code handshake authenticates the receiver's own certificate
+		refusal = errors.New("transfer codes need end-to-end TLS")
+		biewire.SendJSON(authStream, biewire.ClientResponse{Error: refusal.Error()})
+		return
+	}
+
+	// Streams opened from here on pass half-closes of senders
+	if req.HalfClose {
+		session = transport.WithHalfClose(session)
+	}
+
+	receiver := audit.Receiver{ID: audit.Hash(req.AuthToken), IP: hostOf(session.RemoteAddr())}
+	var token string
+	var res *reservation
+	if req.ResumeToken != "" {
+		token = req.ResumeToken
+		res = resumeReservation(token, req.ResumeSecret, session, receiver, span.SpanContext())
+		if res == nil && predecessor != nil {
+			res = takeOverReservation(ctx, predecessor, token, req.ResumeSecret, session, receiver, span.SpanContext())
+		}
+		if res == nil {
+			refusal = errors.New("registration cannot be resumed")
+			biewire.SendJSON(authStream, biewire.ClientResponse{Error: refusal.Error()})
+			logger.WarnContext(ctx, "Refused to resume token", tokenAttr(token))
+			return
+		}
+	} else {
+		_, issue := bietrace.Tracer().Start(ctx, "relay.issue_token")
+		// Generate `SHARD-ID-XID`
+		shardID := cfg.ShardID
+		xid := generateSecureToken()
+		token = strings.ToLower(fmt.Sprintf("%s-%s", shardID, xid))
+
+		res = &reservation{
+			secret:    generateSecureToken(),
+			session:   session,
+			receiver:  receiver,
+			intention: req.Intention,
+			trace:     span.SpanContext(),
+		}
+		// Reserve a nameplate for the transfer code
+		if req.Code {
+			res.nameplate = allocateNameplate(token)
+		}
+		connectionStore.Lock()
+		connectionStore.reservations[token] = res
+		connectionStore.Unlock()
+		issue.End()
+	}
 
 	// Sending token to client
-	clientResponse := biewire.ClientResponse{Token: token}
+	clientResponse := biewire.ClientResponse{
+		Token:           token,
+		Nameplate:       res.nameplate,
+		ResumeSecret:    res.secret,
+		HalfClose:       req.HalfClose,
+		TransferReports: true,
+	}
+	logger = logger.With(tokenAttr(token))
+	ctx = bielog.CtxWithLogger(ctx, logger)
 	if err := biewire.SendJSON(authStream, clientResponse); err != nil {
-		log.Println("Failed to send JSON response:", err)
+		refusal = err
+		logger.WarnContext(ctx, "Failed to send JSON response", "err", err)
+		releaseToken(ctx, token, session, cfg.ResumeGrace)
 		return
 	}
+	// Done with it, the receiver waits for it to close before hanging up
+	authStream.Close()
 
-	// 4. Open data stream
-	dataStream, err := session.OpenStream()
-	if err != nil {
-		log.Println("Failed to open data stream:", err)
-		return
+	if req.RelayTLS {
+		connectionStore.Lock()
+		connectionStore.relayTLS[token] = true
+		connectionStore.Unlock()
 	}
-	defer dataStream.Close()
 
-	// Store raw TCP connection
-	connectionStore.Lock()
-	connectionStore.connections[token] = dataStream
-	connectionStore.Unlock()
+	if req.Intention == biewire.IntentionTunnel {
+		// Streams are opened per sender for as long as the tunnel is up
+		connectionStore.Lock()
+		if res.tunnel == nil {
+			res.tunnel = &tunnel{
+				maxConcurrent: lowerLimit(cfg.MaxConcurrentSenders, req.MaxConcurrent),
+				maxTotal:      lowerLimit(cfg.MaxSendersPerToken, req.MaxTotal),
+			}
+		}
+		res.tunnel.session = session
+		connectionStore.tunnels[token] = res.tunnel
+		connectionStore.Unlock()
+	} else {
+		// 4. The data stream is opened once the sender arrives, so a receiver
+		// that lost its connection meanwhile can resume
+		connectionStore.Lock()
+		connectionStore.receivers[token] = session
+		connectionStore.Unlock()
+	}
 
-	log.Printf("Receiver registered with token: %s\n", token)
+	now := time.Now()
+	record := audit.Record{
+		Event:     audit.EventRegister,
+		TokenHash: audit.Hash(token),
+		Intention: req.Intention,
+		Shard:     cfg.ShardID,
+		Receiver:  receiver,
+		Start:     now,
+		End:       now,
+		Outcome:   audit.OutcomeRegistered,
+	}
+	if req.ResumeToken != "" {
+		record.Outcome = audit.OutcomeResumed
+		logger.InfoContext(ctx, "Receiver resumed token", "intention", req.Intention)
+	} else {
+		logger.InfoContext(ctx, "Receiver registered", "intention", req.Intention, "code", req.Code, "relay_tls", req.RelayTLS)
+	}
+	writeAudit(ctx, record)
+	endRegistration()
+	go acceptReports(ctx, session)
 
 	// Create a ticker to check connection status every minute
 	ticker := time.NewTicker(5 * time.Second)
@@ -127,76 +551,492 @@ func registerReceiver(conn net.Conn, cfg Config, certProvider certs.Provider) {
 		}
 	}
 
-	// When the receiver disconnects, delete the token
+	// When the receiver disconnects, keep the token for it to resume
+	releaseToken(ctx, token, session, cfg.ResumeGrace)
+}
+
+// Hands the reservation of token over to session of receiver if secret
+// matches, senders from now on join the trace of span. A session still
+// holding it is closed, the receiver already left it.
+func resumeReservation(token, secret string, session transport.Session, receiver audit.Receiver, span trace.SpanContext) *reservation {
 	connectionStore.Lock()
-	delete(connectionStore.connections, token)
+	res, ok := connectionStore.reservations[token]
+	if !ok || subtle.ConstantTimeCompare([]byte(res.secret), []byte(secret)) != 1 {
+		connectionStore.Unlock()
+		return nil
+	}
+	if res.expiry != nil {
+		res.expiry.Stop()
+		res.expiry = nil
+	}
+	previous := res.session
+	res.session = session
+	res.receiver = receiver
+	res.trace = span
 	connectionStore.Unlock()
-	log.Printf("Token expired: %s\n", token)
+
+	if previous != nil {
+		previous.Close()
+	}
+	return res
 }
 
-// Forwards sender connection to the receiver and deletes token after first use
-func forwardSender(conn net.Conn, cfg Config) {
+// Asks a receiver's registration to resume from the predecessor
+type resumeCall struct {
+	Token  string `json:"token"`
+	Secret string `json:"secret"`
+}
+
+// What the successor needs of a registration to resume it
+type reservationState struct {
+	Nameplate string       `json:"nameplate,omitempty"`
+	Intention string       `json:"intention"`
+	Tunnel    *tunnelState `json:"tunnel,omitempty"`
+}
+
+type tunnelState struct {
+	MaxConcurrent int `json:"max_concurrent"`
+	MaxTotal      int `json:"max_total"`
+	Total         int `json:"total"`
+}
+
+// Hands the registration of a receiver that reconnected to our successor
+// over to it, if the secret of the call matches. We forget the token and
+// drop the session still holding it. Registrations we took over from our
+// own predecessor and nobody resumed yet are asked from it in turn.
+func handOverReservation(ctx context.Context, call resumeCall, predecessor *handoff.Predecessor) (reservationState, error) {
+	connectionStore.Lock()
+	res, ok := connectionStore.reservations[call.Token]
+	if !ok {
+		connectionStore.Unlock()
+		if predecessor == nil {
+			return reservationState{}, errors.New("registration cannot be resumed")
+		}
+		var state reservationState
+		err := predecessor.Call(ctx, call, &state)
+		return state, err
+	}
+	if subtle.ConstantTimeCompare([]byte(res.secret), []byte(call.Secret)) != 1 {
+		connectionStore.Unlock()
+		return reservationState{}, errors.New("registration cannot be resumed")
+	}
+
+	if res.expiry != nil {
+		res.expiry.Stop()
+		res.expiry = nil
+	}
+	state := reservationState{Nameplate: res.nameplate, Intention: res.intention}
+	if res.tunnel != nil {
+		state.Tunnel = &tunnelState{
+			MaxConcurrent: res.tunnel.maxConcurrent,
+			MaxTotal:      res.tunnel.maxTotal,
+			Total:         res.tunnel.total,
+		}
+	}
+	previous := res.session
+	delete(connectionStore.receivers, call.Token)
+	delete(connectionStore.tunnels, call.Token)
+	deleteToken(call.Token)
+	connectionStore.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+	bielog.FromCtx(ctx).InfoContext(ctx, "Registration handed over to successor", tokenAttr(call.Token))
+	return state, nil
+}
+
+// Takes the registration of token over from predecessor for session of
+// receiver, like resumeReservation. Nil if the predecessor refuses.
+func takeOverReservation(ctx context.Context, predecessor *handoff.Predecessor, token, secret string, session transport.Session, receiver audit.Receiver, span trace.SpanContext) *reservation {
+	callCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var state reservationState
+	if err := predecessor.Call(callCtx, resumeCall{Token: token, Secret: secret}, &state); err != nil {
+		bielog.FromCtx(ctx).InfoContext(ctx, "Predecessor did not hand registration over", tokenAttr(token), "err", err)
+		return nil
+	}
+
+	res := &reservation{
+		secret:    secret,
+		session:   session,
+		receiver:  receiver,
+		intention: state.Intention,
+		trace:     span,
+	}
+	if state.Tunnel != nil {
+		res.tunnel = &tunnel{
+			maxConcurrent: state.Tunnel.MaxConcurrent,
+			maxTotal:      state.Tunnel.MaxTotal,
+			total:         state.Tunnel.Total,
+		}
+	}
+
+	connectionStore.Lock()
+	defer connectionStore.Unlock()
+	if _, taken := connectionStore.reservations[token]; taken {
+		return nil
+	}
+	// Its transfer code keeps working unless we gave the nameplate away
+	if _, taken := connectionStore.nameplates[state.Nameplate]; state.Nameplate != "" && !taken {
+		res.nameplate = state.Nameplate
+		connectionStore.nameplates[res.nameplate] = token
+	}
+	connectionStore.reservations[token] = res
+	return res
+}
+
+// Unroutes token once session is gone. Unless it was used up or resumed by
+// a newer session, the token stays reserved for grace.
+func releaseToken(ctx context.Context, token string, session transport.Session, grace time.Duration) {
+	connectionStore.Lock()
+	defer connectionStore.Unlock()
+
+	res, reserved := connectionStore.reservations[token]
+	if reserved && res.session != session {
+		// A newer session owns the token now
+		return
+	}
+	if connectionStore.receivers[token] == session {
+		delete(connectionStore.receivers, token)
+	}
+	delete(connectionStore.tunnels, token)
+
+	if reserved && grace > 0 {
+		res.session = nil
+		res.expiry = time.AfterFunc(grace, func() { expireReservation(ctx, token, res) })
+		bielog.FromCtx(ctx).InfoContext(ctx, "Receiver disconnected, token reserved", "grace", grace)
+		return
+	}
+	deleteToken(token)
+	bielog.FromCtx(ctx).InfoContext(ctx, "Token expired", tokenAttr(token))
+}
+
+// Deletes a reservation nobody resumed within the grace period
+func expireReservation(ctx context.Context, token string, res *reservation) {
+	connectionStore.Lock()
+	defer connectionStore.Unlock()
+
+	if connectionStore.reservations[token] != res || res.session != nil {
+		return
+	}
+	deleteToken(token)
+	bielog.FromCtx(ctx).InfoContext(ctx, "Token expired", tokenAttr(token))
+}
+
+// Forgets the reservation, nameplate and TLS mode of token, connectionStore
+// must be locked
+func deleteToken(token string) {
+	if res, ok := connectionStore.reservations[token]; ok && res.nameplate != "" {
+		delete(connectionStore.nameplates, res.nameplate)
+	}
+	delete(connectionStore.reservations, token)
+	delete(connectionStore.relayTLS, token)
+}
+
+// Routes a receiver connection by its first bytes: WebSocket upgrades go to
+// the HTTP server behind wsListener, anything else is a smux session
+func acceptReceiver(ctx context.Context, conn net.Conn, cfg Config, certProvider certs.Provider, predecessor *handoff.Predecessor, wsListener *osserver.ConnListener) {
+	peeked, isHTTP, err := transport.SniffHTTP(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if isHTTP {
+		if err := wsListener.Push(peeked); err != nil {
+			conn.Close()
+		}
+		return
+	}
+	registerReceiver(ctx, peeked, cfg, certProvider, predecessor)
+}
+
+// Picks the lowest free nameplate for token, keeping transfer codes short
+func allocateNameplate(token string) string {
+	connectionStore.Lock()
+	defer connectionStore.Unlock()
+
+	for n := 1; ; n++ {
+		nameplate := strconv.Itoa(n)
+		if _, taken := connectionStore.nameplates[nameplate]; !taken {
+			connectionStore.nameplates[nameplate] = token
+			return nameplate
+		}
+	}
+}
+
+// Logs the reports of finished transfers the receiver sends over new streams
+// of its session, until the session is closed
+func acceptReports(ctx context.Context, session transport.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		var req biewire.ClientRequest
+		stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+		err = biewire.ReceiveJSON(stream, &req)
+		stream.Close()
+		if err != nil || req.Intention != biewire.IntentionReport || req.Transfer == nil {
+			continue
+		}
+
+		report := req.Transfer
+		bielog.FromCtx(ctx).InfoContext(ctx, "Receiver reported transfer",
+			"bytes", report.Bytes, "logical_bytes", report.LogicalBytes, "encoding", report.Encoding)
+	}
+}
+
+// Pairs a sender holding a transfer code with the receiver of its nameplate.
+// Like tokens, the receiver is gone after the first attempt, so a wrong
+// guess of the code's password burns it.
+func joinReceiver(ctx context.Context, stream net.Conn, nameplate string, cfg Config) {
+	start := time.Now()
+	logger := bielog.FromCtx(ctx).With("nameplate", nameplate)
+	ctx = bielog.CtxWithLogger(ctx, logger)
+
+	connectionStore.Lock()
+	token, exists := connectionStore.nameplates[nameplate]
+	var receiver transport.Session
+	var record audit.Record
+	var span trace.Span
+	if exists {
+		receiver, exists = connectionStore.receivers[token]
+		delete(connectionStore.receivers, token)
+		record = newTransferRecord(token, stream, cfg)
+		ctx, span = startSenderSpan(ctx, token, start)
+	}
+	connectionStore.Unlock()
+
+	if !exists {
+		biewire.SendJSON(stream, biewire.ClientResponse{Error: "no receiver for this code"})
+		logger.WarnContext(ctx, "No receiver found for nameplate")
+		return
+	}
+	defer span.End()
+	traceLookup(ctx, start)
+	logger = logger.With(tokenAttr(token))
+	ctx = bielog.CtxWithLogger(ctx, logger)
+	receiverConn, err := openReceiverStream(ctx, token, receiver)
+	if err != nil {
+		biewire.SendJSON(stream, biewire.ClientResponse{Error: "receiver is reconnecting"})
+		logger.WarnContext(ctx, "Failed to open data stream", "err", err)
+		auditRefusal(ctx, record, "receiver is reconnecting")
+		return
+	}
+	defer receiverConn.Close()
+
+	if err := biewire.SendJSON(stream, biewire.ClientResponse{}); err != nil {
+		logger.WarnContext(ctx, "Failed to send JSON response", "err", err)
+		auditRefusal(ctx, record, "sender left")
+		return
+	}
+
+	logger.InfoContext(ctx, "Forwarding sender to receiver by nameplate")
+	summary := pipeSender(ctx, stream, receiverConn, cfg)
+	logger.InfoContext(ctx, "Sender done", "pipe", summary)
+	auditTransfer(ctx, record, summary)
+}
+
+// Forwards sender connection to the receiver and deletes token after first use.
+// Unknown tokens may belong to the relay we took over from, so they are passed
+// back to it when there is one. Receivers that opted into relay-terminated TLS
+// get the sender's plain traffic, decrypted with tlsConfig.
+func forwardSender(ctx context.Context, conn net.Conn, cfg Config, tlsConfig *tls.Config, predecessor *handoff.Predecessor) {
 	defer conn.Close()
+	start := time.Now()
+
+	logger := bielog.FromCtx(ctx).With("remote_addr", conn.RemoteAddr().String())
 
 	// Extract SNI
 	tcpConn, ok := conn.(*net.TCPConn)
 	if !ok {
-		log.Println("Connection is not TCP")
+		logger.ErrorContext(ctx, "Connection is not TCP")
 		return
 	}
 	serverName, err := biewire.PeekClientHello(tcpConn)
 	if serverName == "" || err != nil {
-		log.Println("Invalid TLS handshake, no SNI found")
+		logger.WarnContext(ctx, "Invalid TLS handshake, no SNI found", "err", err)
 		return
 	}
 	serverName = strings.ToLower(serverName)
 
 	// Parse `SHARD-ID-XID.relay.com`
 	token := strings.Split(serverName, ".")[0]
+	logger = logger.With(tokenAttr(token))
+	ctx = bielog.CtxWithLogger(ctx, logger)
 
 	// Find receiver connection
 	connectionStore.Lock()
-	receiverConn, exists := connectionStore.connections[token]
+	if connectionStore.relayTLS[token] {
+		tlsConn := tls.Server(conn, tlsConfig)
+		defer tlsConn.Close()
+		conn = tlsConn
+	}
+	receiver, exists := connectionStore.receivers[token]
+	if t, isTunnel := connectionStore.tunnels[token]; isTunnel {
+		record := newTransferRecord(token, conn, cfg)
+		ctx, span := startSenderSpan(ctx, token, start)
+		defer span.End()
+		connectionStore.Unlock()
+		traceLookup(ctx, start)
+		forwardToTunnel(ctx, conn, t, record, cfg)
+		return
+	}
 	if !exists {
 		connectionStore.Unlock()
-		log.Printf("No receiver found for token: %s\n", token)
+		if predecessor != nil {
+			if err := predecessor.Forward(tcpConn); err == nil {
+				return
+			}
+		}
+		logger.WarnContext(ctx, "No receiver found for token")
 		return
 	}
 
 	// Delete the token immediately after first connection is piped
-	delete(connectionStore.connections, token)
+	delete(connectionStore.receivers, token)
+	record := newTransferRecord(token, conn, cfg)
+	ctx, span := startSenderSpan(ctx, token, start)
+	defer span.End()
 	connectionStore.Unlock()
-	log.Printf("Token expired after first use: %s\n", token)
+	traceLookup(ctx, start)
+
+	receiverConn, err := openReceiverStream(ctx, token, receiver)
+	if err != nil {
+		logger.WarnContext(ctx, "Failed to open data stream", "err", err)
+		auditRefusal(ctx, record, "receiver is reconnecting")
+		return
+	}
+	defer receiverConn.Close()
 
 	// Forward raw TCP traffic
-	log.Printf("Forwarding sender to receiver: %s\n", token)
-	pipeConnections(conn, receiverConn)
+	logger.InfoContext(ctx, "Forwarding sender to receiver")
+	summary := pipeSender(ctx, conn, receiverConn, cfg)
+	logger.InfoContext(ctx, "Sender done", "pipe", summary)
+	auditTransfer(ctx, record, summary)
 }
 
-// Pipes two TCP connections together (bi-directional forwarding)
-func pipeConnections(conn1, conn2 net.Conn) {
-	go func() {
-		io.Copy(conn1, conn2)
-		conn1.Close()
-		conn2.Close()
+// Opens the data stream to a one-shot receiver the caller took out of
+// connectionStore, which uses its token up. A receiver whose connection
+// dropped is closed instead, its token stays reserved for it to resume.
+func openReceiverStream(ctx context.Context, token string, receiver transport.Session) (net.Conn, error) {
+	stream, err := receiver.OpenStream()
+	if err != nil {
+		receiver.Close()
+		return nil, err
+	}
+
+	connectionStore.Lock()
+	if res, ok := connectionStore.reservations[token]; ok && res.session == receiver {
+		deleteToken(token)
+	}
+	connectionStore.Unlock()
+	bielog.FromCtx(ctx).InfoContext(ctx, "Token expired after first use")
+	return stream, nil
+}
+
+// Forwards a sender over a new stream of the tunnel, which stays registered.
+// Senders over the tunnel's limits are dropped.
+func forwardToTunnel(ctx context.Context, conn net.Conn, t *tunnel, record audit.Record, cfg Config) {
+	logger := bielog.FromCtx(ctx)
+	connectionStore.Lock()
+	if t.maxConcurrent > 0 && t.active >= t.maxConcurrent {
+		connectionStore.Unlock()
+		logger.WarnContext(ctx, "Too many concurrent senders for token", "max_concurrent", t.maxConcurrent)
+		auditRefusal(ctx, record, "too many concurrent senders")
+		return
+	}
+	if t.maxTotal > 0 && t.total >= t.maxTotal {
+		connectionStore.Unlock()
+		logger.WarnContext(ctx, "Sender limit reached for token", "max_total", t.maxTotal)
+		auditRefusal(ctx, record, "sender limit reached")
+		return
+	}
+	t.active++
+	t.total++
+	session := t.session
+	connectionStore.Unlock()
+
+	defer func() {
+		connectionStore.Lock()
+		t.active--
+		connectionStore.Unlock()
 	}()
-	io.Copy(conn2, conn1)
-	conn1.Close()
-	conn2.Close()
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		logger.WarnContext(ctx, "Failed to open tunnel stream", "err", err)
+		auditRefusal(ctx, record, "failed to open tunnel stream")
+		return
+	}
+
+	logger.InfoContext(ctx, "Forwarding sender to tunnel")
+	summary := pipeSender(ctx, conn, stream, cfg)
+	logger.InfoContext(ctx, "Sender done", "pipe", summary)
+	auditTransfer(ctx, record, summary)
+}
+
+// Returns the stricter of the relay's and the receiver's limit, 0 is unlimited
+func lowerLimit(relay, requested int) int {
+	if requested > 0 && (relay == 0 || requested < relay) {
+		return requested
+	}
+	return relay
 }
 
 func main() {
 	cfg, err := env.ParseAs[Config]()
 	if err != nil {
-		log.Fatalf("Failed to parse environment variables: %v", err)
+		// The environment configures the logger, so it is not there yet
+		slog.Error("Failed to parse environment variables", "err", err)
+		os.Exit(1)
+	}
+
+	// Setting up logger, libraries using the standard logger go through it too
+	logger, logCloser, err := bielog.NewLogger(cfg.logConfig(), nil)
+	if err != nil {
+		slog.Error("Invalid log settings", "err", err)
+		os.Exit(1)
+	}
+	defer logCloser.Close()
+	logger = logger.With("shard", cfg.ShardID)
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := bietrace.Setup(context.Background(), bietrace.Config{
+		Endpoint:    cfg.OTLPEndpoint,
+		ServiceName: "bie-relay",
+		SampleRatio: cfg.TraceSampleRatio,
+	})
+	if err != nil {
+		logger.Error("Invalid trace settings", "err", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	if cfg.AuditFile != "" {
+		sink, err := audit.OpenFile(cfg.AuditFile)
+		if err != nil {
+			logger.Error("Failed to open audit log", "err", err)
+			os.Exit(1)
+		}
+		auditLog = sink
+		defer auditLog.Close()
+	}
+
+	if _, err := cfg.smuxParams().Config(); err != nil {
+		logger.Error("Invalid smux settings", "err", err)
+		os.Exit(1)
+	}
+	// HTTP-01 challenges cannot get wildcard certificates
+	if cfg.RelayTLS && cfg.CertProvider == "acme" {
+		logger.Error("Relay-terminated TLS needs a wildcard certificate, which the ACME provider cannot obtain")
+		os.Exit(1)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-
-	// Setting up logger
-	logger := bielog.NewLogger(cfg.LogType, cfg.LogLevel, nil)
-	ctx = bielog.CtxWithLogger(ctx, bielog.FromCtx(ctx))
+	ctx = bielog.CtxWithLogger(ctx, logger)
 
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -205,93 +1045,279 @@ func main() {
 	var wg sync.WaitGroup
 
 	// Create and start certificate provider
-	certProvider := certs.NewFSProvider(
-		cfg.Domain,
-		cfg.CertFile,
-		cfg.KeyFile,
-		certs.NewLoggerAdapter(logger, ctx),
-	)
+	certProvider, err := newCertProvider(cfg, certs.NewLoggerAdapter(logger, ctx))
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to create certificate provider", "err", err)
+		return
+	}
 	if err := certProvider.Start(ctx); err != nil {
-		logger.ErrorContext(ctx, "Failed to start certificate provider:", err)
+		logger.ErrorContext(ctx, "Failed to start certificate provider", "err", err)
 		return
 	}
 	defer certProvider.Stop()
+	if cfg.RelayTLS {
+		if err := checkWildcardCert(cfg.Domain, certProvider); err != nil {
+			logger.ErrorContext(ctx, "Relay-terminated TLS needs a wildcard certificate", "err", err)
+			return
+		}
+	}
 
-	tlsConfig := &tls.Config{
-		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			// You can inspect hello.ServerName here if needed (for SNI)
-			// Load from cache, memory, file, or secret manager
-			cert := certProvider.GetCertificate() // your custom function
-			if err != nil {
-				return nil, err
+	// Reload certificates on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			if reloader, ok := certProvider.(certs.Reloader); ok {
+				reloader.Reload()
 			}
-			return cert, nil
-		},
+		}
+	}()
+
+	tlsConfig := certs.TLSConfig(certProvider)
+	// Relay-terminated TLS of senders carries HTTP/1.1 to the receiver
+	senderTLSConfig := tlsConfig.Clone()
+	senderTLSConfig.NextProtos = []string{"http/1.1"}
+
+	// Take the listeners over from a running relay, if there is one
+	var predecessor *handoff.Predecessor
+	inherited := map[string]*os.File{}
+	if cfg.UpgradeSocket != "" {
+		pred, files, err := handoff.Inherit(cfg.UpgradeSocket)
+		switch {
+		case errors.Is(err, handoff.ErrNoPredecessor):
+		case err != nil:
+			logger.ErrorContext(ctx, "Failed to inherit listeners", "err", err)
+			return
+		default:
+			logger.InfoContext(ctx, "Inherited listeners from previous relay", "listeners", len(files))
+			predecessor, inherited = pred, files
+			defer predecessor.Close()
+		}
 	}
 
 	// Start two listeners - one for senders and one for receivers
-	senderListener, err := net.Listen("tcp", net.JoinHostPort("", fmt.Sprintf("%d", cfg.SenderPort)))
+	senderTCP, err := listenTCP("sender", cfg.SenderPort, inherited)
 	if err != nil {
-		logger.ErrorContext(ctx, "Failed to start sender relay server:", err)
+		logger.ErrorContext(ctx, "Failed to start sender relay server", "err", err)
 		return
 	}
+	var senderListener net.Listener = senderTCP
 	defer senderListener.Close()
 
 	// Here - multiplexer with TLS
-	receiverListener, err := tls.Listen("tcp", net.JoinHostPort("", fmt.Sprintf("%d", cfg.ReceiverPort)), tlsConfig)
+	receiverTCP, err := listenTCP("receiver", cfg.ReceiverPort, inherited)
 	if err != nil {
-		logger.ErrorContext(ctx, "Failed to start receiver relay server:", err)
+		logger.ErrorContext(ctx, "Failed to start receiver relay server", "err", err)
 		return
 	}
+	receiverListener := tls.NewListener(receiverTCP, tlsConfig)
 	defer receiverListener.Close()
 
-	logger.InfoContext(ctx, "Relay server running. Sender port: %d, Receiver port: %d\n", cfg.SenderPort, cfg.ReceiverPort)
+	// WebSocket receivers are sniffed on the receiver listener and served here
+	wsListener := osserver.NewConnListener(receiverListener.Addr())
+	defer wsListener.Close()
+	wsServer := &http.Server{
+		Handler: transport.WebSocketHandler(func(conn net.Conn) {
+			registerReceiver(ctx, conn, cfg, certProvider, predecessor)
+		}),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go wsServer.Serve(wsListener)
+	defer wsServer.Close()
+
+	// QUIC receivers use the same port over UDP
+	var receiverUDP *net.UDPConn
+	var quicListener *quic.Listener
+	if cfg.QUIC {
+		receiverUDP, err = listenUDP("receiver-quic", cfg.ReceiverPort, inherited)
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to start QUIC receiver server", "err", err)
+			return
+		}
+		defer receiverUDP.Close()
+
+		quicTLSConfig := tlsConfig.Clone()
+		quicTLSConfig.NextProtos = []string{transport.QUICALPN}
+		quicListener, err = quic.Listen(receiverUDP, quicTLSConfig, transport.QUICConfig)
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to start QUIC receiver server", "err", err)
+			return
+		}
+		defer quicListener.Close()
+		if cfg.UpgradeSocket != "" {
+			logger.WarnContext(ctx, "QUIC receivers are dropped on upgrades rather than drained")
+		}
+	}
+
+	// Probes of the relay's health, for orchestrators like Kubernetes
+	var adminTCP *net.TCPListener
+	var adminServer *http.Server
+	if cfg.AdminPort != 0 {
+		adminTCP, err = listenTCP("admin", cfg.AdminPort, inherited)
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to start admin server", "err", err)
+			return
+		}
+		defer adminTCP.Close()
+
+		mux := http.NewServeMux()
+		mux.Handle("GET /healthz", health.Handler(healthChecks(cfg, certProvider, false), cfg.HealthTimeout))
+		mux.Handle("GET /readyz", health.Handler(healthChecks(cfg, certProvider, true), cfg.HealthTimeout))
+		adminServer = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go adminServer.Serve(adminTCP)
+		defer adminServer.Close()
+	}
+
+	logger.InfoContext(ctx, "Relay server running", "sender_port", cfg.SenderPort, "receiver_port", cfg.ReceiverPort, "quic", cfg.QUIC, "admin_port", cfg.AdminPort)
+
+	// Wait for a new relay process to take our listeners over
+	handedOff := make(chan *handoff.Successor, 1)
+	if cfg.UpgradeSocket != "" {
+		upgradeServer, err := handoff.Listen(cfg.UpgradeSocket)
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to start upgrade socket", "err", err)
+			return
+		}
+		defer upgradeServer.Close()
+
+		listeners := map[string]fileListener{
+			"sender":   senderTCP,
+			"receiver": receiverTCP,
+		}
+		if receiverUDP != nil {
+			listeners["receiver-quic"] = receiverUDP
+		}
+		if adminTCP != nil {
+			listeners["admin"] = adminTCP
+		}
+		files, err := listenerFiles(listeners)
+		if err != nil {
+			logger.ErrorContext(ctx, "Failed to prepare listeners for handoff", "err", err)
+			return
+		}
+
+		go func() {
+			defer closeFiles(files)
+			successor, err := upgradeServer.Accept(files)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logger.ErrorContext(ctx, "Failed to hand listeners off", "err", err)
+				}
+				return
+			}
+			handedOff <- successor
+		}()
+	}
 
 	// Start receiver handler
+	listenerStarted("receiver", receiverListener.Addr())
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		for {
 			select {
 			case <-ctx.Done():
+				listenerStopped("receiver", nil)
 				return
 			default:
 				conn, err := receiverListener.Accept()
 				if err != nil {
 					if !errors.Is(err, net.ErrClosed) {
-						logger.ErrorContext(ctx, "Failed to accept receiver connection:", err)
+						logger.ErrorContext(ctx, "Failed to accept receiver connection", "err", err)
 					}
+					listenerStopped("receiver", err)
 					return
 				}
-				go registerReceiver(conn, cfg, certProvider)
+				go acceptReceiver(ctx, conn, cfg, certProvider, predecessor, wsListener)
 			}
 		}
 	}()
 
+	// Start QUIC receiver handler
+	if quicListener != nil {
+		listenerStarted("receiver-quic", receiverUDP.LocalAddr())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				conn, err := quicListener.Accept(ctx)
+				if err != nil {
+					if !errors.Is(err, quic.ErrServerClosed) && ctx.Err() == nil {
+						logger.ErrorContext(ctx, "Failed to accept QUIC receiver connection", "err", err)
+						listenerStopped("receiver-quic", err)
+					} else {
+						listenerStopped("receiver-quic", nil)
+					}
+					return
+				}
+				go serveReceiver(ctx, transport.QUICSession(conn), cfg, certProvider, predecessor)
+			}
+		}()
+	}
+
 	// Start sender handler
+	listenerStarted("sender", senderListener.Addr())
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		for {
 			select {
 			case <-ctx.Done():
+				listenerStopped("sender", nil)
 				return
 			default:
 				conn, err := senderListener.Accept()
 				if err != nil {
 					if !errors.Is(err, net.ErrClosed) {
-						logger.ErrorContext(ctx, "Failed to accept sender connection:", err)
+						logger.ErrorContext(ctx, "Failed to accept sender connection", "err", err)
 					}
+					listenerStopped("sender", err)
 					return
 				}
-				go forwardSender(conn, cfg)
+				go forwardSender(ctx, conn, cfg, senderTLSConfig, predecessor)
 			}
 		}
 	}()
 
-	// Wait for shutdown signal
-	<-sigChan
-	logger.InfoContext(ctx, "Shutting down servers...")
+	// Wait for shutdown signal or handoff
+	select {
+	case <-sigChan:
+		draining.Store(true)
+		logger.InfoContext(ctx, "Shutting down servers...")
+	case successor := <-handedOff:
+		draining.Store(true)
+		logger.InfoContext(ctx, "Listeners handed off, draining registered receivers")
+		senderListener.Close()
+		receiverListener.Close()
+		// QUIC connections share the socket with the successor, they cannot be
+		// drained and are dropped here
+		if quicListener != nil {
+			quicListener.Close()
+			receiverUDP.Close()
+		}
+		// The successor answers the probes now
+		if adminServer != nil {
+			adminServer.Close()
+		}
+
+		// Senders for our receivers now arrive through the successor, and
+		// our receivers reconnecting to it resume their registrations there
+		go successor.Serve(func(conn net.Conn) {
+			go forwardSender(ctx, conn, cfg, senderTLSConfig, predecessor)
+		}, func(body json.RawMessage) (any, error) {
+			var call resumeCall
+			if err := json.Unmarshal(body, &call); err != nil {
+				return nil, err
+			}
+			return handOverReservation(ctx, call, predecessor)
+		})
+
+		waitDrained(cfg.DrainTimeout, sigChan)
+		successor.Close()
+	}
 
 	// Initiate graceful shutdown
 	cancel()
@@ -302,3 +1328,302 @@ func main() {
 	wg.Wait()
 	logger.InfoContext(ctx, "Servers stopped gracefully")
 }
+
+// newCertProvider creates the certificate provider of the main domain and of
+// each extra domain, as selected in the config. All ACME domains share one
+// ACME provider, so one HTTP-01 listener answers for all of them.
+func newCertProvider(cfg Config, logger certs.Logger) (certs.Provider, error) {
+	for domain := range cfg.ExtraCertProviders {
+		if !slices.Contains(cfg.ExtraDomains, domain) {
+			return nil, fmt.Errorf("certificate provider set for %q, which is not an extra domain", domain)
+		}
+	}
+
+	var acmeDomains []string
+	if cfg.CertProvider == "acme" {
+		acmeDomains = append(acmeDomains, cfg.Domain)
+	}
+	for _, domain := range cfg.ExtraDomains {
+		switch provider := cmp.Or(cfg.ExtraCertProviders[domain], "fs"); provider {
+		case "fs":
+		case "acme":
+			acmeDomains = append(acmeDomains, domain)
+		default:
+			return nil, fmt.Errorf("unknown certificate provider %q for domain %q", provider, domain)
+		}
+	}
+	var acmeProvider *certs.ACMEProvider
+	if len(acmeDomains) > 0 {
+		// TLS-ALPN-01 would reach the sender port, which passes TLS through
+		if cfg.ACMEHTTPAddr == "" {
+			return nil, errors.New("ACME certificates need BIE_ACME_HTTP_ADDR to answer HTTP-01 challenges")
+		}
+		acmeProvider = certs.NewACMEProvider(certs.ACMEConfig{
+			Domain:       acmeDomains[0],
+			ExtraDomains: acmeDomains[1:],
+			Email:        cfg.Email,
+			CacheDir:     cfg.ACMECacheDir,
+			DirectoryURL: cfg.ACMEDirectoryURL,
+			CARootFile:   cfg.ACMECARoot,
+			HTTPAddr:     cfg.ACMEHTTPAddr,
+			RenewBefore:  cfg.ACMERenewBefore,
+		}, logger)
+	}
+
+	var mainProvider certs.Provider
+	switch cfg.CertProvider {
+	case "fs":
+		mainProvider = certs.NewFSProvider(cfg.Domain, cfg.CertFile, cfg.KeyFile, logger)
+	case "acme":
+		mainProvider = acmeProvider
+	default:
+		return nil, fmt.Errorf("unknown certificate provider %q", cfg.CertProvider)
+	}
+	if len(cfg.ExtraDomains) == 0 {
+		return mainProvider, nil
+	}
+
+	sniProvider := certs.NewSNIProvider(mainProvider)
+	sniProvider.Add(cfg.Domain, mainProvider)
+	sniProvider.Add("*."+cfg.Domain, mainProvider)
+	for _, domain := range cfg.ExtraDomains {
+		var domainProvider certs.Provider = acmeProvider
+		if !slices.Contains(acmeDomains, domain) {
+			domainProvider = certs.NewFSProvider(
+				domain,
+				filepath.Join(cfg.CertDir, domain, "fullchain.pem"),
+				filepath.Join(cfg.CertDir, domain, "privkey.pem"),
+				logger,
+			)
+		}
+		sniProvider.Add(domain, domainProvider)
+		sniProvider.Add("*."+domain, domainProvider)
+	}
+	return sniProvider, nil
+}
+
+// checkWildcardCert makes sure the certificate served for the subdomains of
+// domain covers all of them, as relay-terminated TLS needs
+func checkWildcardCert(domain string, certProvider certs.Provider) error {
+	// Any name of a token does, the certificate is picked by SNI
+	domain = strings.ToLower(domain)
+	name := "relay-tls-check." + domain
+	leaf, err := certProvider.Current(name)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(leaf.DNSNames, "*."+domain) {
+		return fmt.Errorf("certificate for %s does not cover *.%s", name, domain)
+	}
+	return nil
+}
+
+// listenTCP returns the inherited listener with the given name, or listens on port
+func listenTCP(name string, port int, inherited map[string]*os.File) (*net.TCPListener, error) {
+	if f, ok := inherited[name]; ok {
+		defer f.Close()
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to use inherited %s listener: %w", name, err)
+		}
+		tcpLn, ok := ln.(*net.TCPListener)
+		if !ok {
+			ln.Close()
+			return nil, fmt.Errorf("inherited %s listener is not TCP", name)
+		}
+		return tcpLn, nil
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenUDP returns the inherited socket with the given name, or listens on port
+func listenUDP(name string, port int, inherited map[string]*os.File) (*net.UDPConn, error) {
+	if f, ok := inherited[name]; ok {
+		defer f.Close()
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to use inherited %s socket: %w", name, err)
+		}
+		udpConn, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return nil, fmt.Errorf("inherited %s socket is not UDP", name)
+		}
+		return udpConn, nil
+	}
+
+	return net.ListenUDP("udp", &net.UDPAddr{Port: port})
+}
+
+// Listeners whose file descriptor can be handed off
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// listenerFiles duplicates the listeners' file descriptors for the handoff
+func listenerFiles(listeners map[string]fileListener) (map[string]*os.File, error) {
+	files := make(map[string]*os.File, len(listeners))
+	for name, ln := range listeners {
+		f, err := ln.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files[name] = f
+	}
+	return files, nil
+}
+
+func closeFiles(files map[string]*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// waitDrained blocks until every registered receiver is gone and no token is
+// reserved for one to resume, the timeout passes or a shutdown signal arrives
+func waitDrained(timeout time.Duration, sigChan <-chan os.Signal) {
+	drained := make(chan struct{})
+	go func() {
+		activeSessions.Wait()
+		// Receivers that disconnected may still resume through the successor
+		for {
+			connectionStore.RLock()
+			reserved := len(connectionStore.reservations)
+			connectionStore.RUnlock()
+			if reserved == 0 {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+	case <-sigChan:
+	}
+}
+
+// listenerStarted records that the accept loop of listener name runs
+func listenerStarted(name string, addr net.Addr) {
+	listenerStore.Lock()
+	defer listenerStore.Unlock()
+	listenerStore.listeners[name] = listenerState{Addr: addr.String(), Accepting: true}
+}
+
+// listenerStopped records that the accept loop of listener name returned
+// with err
+func listenerStopped(name string, err error) {
+	listenerStore.Lock()
+	defer listenerStore.Unlock()
+	state := listenerStore.listeners[name]
+	state.Accepting = false
+	if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, quic.ErrServerClosed) {
+		state.Error = err.Error()
+	}
+	listenerStore.listeners[name] = state
+}
+
+// healthChecks returns the checks of the admin port's probes. Liveness only
+// covers the process itself, so a relay is not restarted over an expired
+// certificate or a closed listener. Readiness also covers those, and fails
+// while the relay drains.
+func healthChecks(cfg Config, certProvider certs.Provider, readiness bool) map[string]health.Check {
+	checks := map[string]health.Check{
+		"registry": checkRegistry,
+		"draining": func(ctx context.Context) (any, error) {
+			if draining.Load() && readiness {
+				return true, errors.New("relay is draining")
+			}
+			return draining.Load(), nil
+		},
+	}
+	if readiness {
+		checks["listeners"] = checkListeners
+		checks["certificates"] = func(ctx context.Context) (any, error) {
+			return checkCertificates(cfg, certProvider)
+		}
+	}
+	return checks
+}
+
+// checkListeners fails when an accept loop stopped, unless the relay drains
+// and closed its listeners on purpose
+func checkListeners(ctx context.Context) (any, error) {
+	listenerStore.RLock()
+	defer listenerStore.RUnlock()
+
+	states := make(map[string]listenerState, len(listenerStore.listeners))
+	var errs []error
+	for name, state := range listenerStore.listeners {
+		states[name] = state
+		if !state.Accepting && !draining.Load() {
+			errs = append(errs, fmt.Errorf("%s listener stopped accepting", name))
+		}
+	}
+	if len(states) == 0 {
+		errs = append(errs, errors.New("no listener accepting yet"))
+	}
+	return states, errors.Join(errs...)
+}
+
+type certificateState struct {
+	Domain    string    `json:"domain,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	ExpiresIn string    `json:"expires_in"`
+}
+
+// checkCertificates fails when the certificate served for any of the relay's
+// domains is missing or outside its validity window
+func checkCertificates(cfg Config, certProvider certs.Provider) (any, error) {
+	now := time.Now()
+	var states []certificateState
+	var errs []error
+	for _, domain := range append([]string{cfg.Domain}, cfg.ExtraDomains...) {
+		leaf, err := certProvider.Current(domain)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		states = append(states, certificateState{
+			Domain:    domain,
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+			ExpiresIn: leaf.NotAfter.Sub(now).Round(time.Second).String(),
+		})
+		switch {
+		case now.Before(leaf.NotBefore):
+			errs = append(errs, fmt.Errorf("certificate of %q is not valid before %s", domain, leaf.NotBefore))
+		case now.After(leaf.NotAfter):
+			errs = append(errs, fmt.Errorf("certificate of %q expired at %s", domain, leaf.NotAfter))
+		}
+	}
+	return states, errors.Join(errs...)
+}
+
+// checkRegistry reports the registry of receivers. It is kept in memory, so
+// there is no backend to reach, but a registry stuck locked fails the check
+// by its timeout.
+func checkRegistry(ctx context.Context) (any, error) {
+	connectionStore.RLock()
+	defer connectionStore.RUnlock()
+	return struct {
+		Backend      string `json:"backend"`
+		Receivers    int    `json:"receivers"`
+		Tunnels      int    `json:"tunnels"`
+		Reservations int    `json:"reservations"`
+	}{
+		Backend:      "memory",
+		Receivers:    len(connectionStore.receivers),
+		Tunnels:      len(connectionStore.tunnels),
+		Reservations: len(connectionStore.reservations),
+	}, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"bie/pkg/bietrace"
+)
+
+// TestSenderSpans checks the spans of a sender: relay.sender joins the trace
+// of the registration, or links to it when the sender brought a trace of its
+// own, and relay.lookup and relay.pipe are its children.
+func TestSenderSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown, err := bietrace.Setup(context.Background(), bietrace.Config{ServiceName: "bie-relay", Exporter: exporter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	_, registration := bietrace.Tracer().Start(context.Background(), "relay.register")
+	registration.End()
+	registered := registration.SpanContext()
+
+	const token = "01-tracetest"
+	connectionStore.Lock()
+	connectionStore.reservations[token] = &reservation{trace: registered}
+	connectionStore.Unlock()
+	defer func() {
+		connectionStore.Lock()
+		delete(connectionStore.reservations, token)
+		connectionStore.Unlock()
+	}()
+
+	_, remote := bietrace.Tracer().Start(context.Background(), "bie.send")
+	remote.End()
+
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		// Parent of relay.sender, registered unless the sender has one
+		parent trace.SpanContext
+		linked bool
+	}{
+		{"registration trace", context.Background(), registered, false},
+		{"sender trace", trace.ContextWithRemoteSpanContext(context.Background(), remote.SpanContext()), remote.SpanContext(), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exporter.Reset()
+			sendSender(t, tc.ctx, token)
+			if err := otel.GetTracerProvider().(*sdktrace.TracerProvider).ForceFlush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			spans := map[string]tracetest.SpanStub{}
+			for _, span := range exporter.GetSpans() {
+				spans[span.Name] = span
+			}
+			sender, ok := spans["relay.sender"]
+			if !ok {
+				t.Fatalf("no relay.sender span in %v", spans)
+			}
+			if sender.Parent.SpanID() != tc.parent.SpanID() || sender.SpanContext.TraceID() != tc.parent.TraceID() {
+				t.Errorf("relay.sender is a child of %s, want %s", sender.Parent.SpanID(), tc.parent.SpanID())
+			}
+			linked := len(sender.Links) == 1 && sender.Links[0].SpanContext.SpanID() == registered.SpanID()
+			if linked != tc.linked {
+				t.Errorf("relay.sender links %v, want a link to the registration: %v", sender.Links, tc.linked)
+			}
+			for _, name := range []string{"relay.lookup", "relay.pipe"} {
+				span, ok := spans[name]
+				if !ok {
+					t.Errorf("no %s span", name)
+					continue
+				}
+				if span.Parent.SpanID() != sender.SpanContext.SpanID() || span.SpanContext.TraceID() != sender.SpanContext.TraceID() {
+					t.Errorf("%s is a child of %s, want relay.sender %s", name, span.Parent.SpanID(), sender.SpanContext.SpanID())
+				}
+			}
+		})
+	}
+}
+
+// sendSender traces a sender of token the way the sender port does, piping
+// it to a receiver that hangs up at once
+func sendSender(t *testing.T, ctx context.Context, token string) {
+	t.Helper()
+	start := time.Now()
+	connectionStore.RLock()
+	ctx, span := startSenderSpan(ctx, token, start)
+	connectionStore.RUnlock()
+	traceLookup(ctx, start)
+
+	senderFar, sender := net.Pipe()
+	receiver, receiverFar := net.Pipe()
+	senderFar.Close()
+	receiverFar.Close()
+	pipeSender(ctx, sender, receiver, Config{})
+	span.End()
+}
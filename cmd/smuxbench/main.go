@@ -0,0 +1,233 @@
+// Command smuxbench measures the throughput of the receiver's smux session
+// on a simulated high bandwidth-delay link: loopback TCP with a fixed round
+// trip time added. It compares smux's defaults with the given parameters,
+// which both ends negotiate like receiver and relay do.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"bie/pkg/transport"
+)
+
+func main() {
+	rtt := flag.Duration("rtt", 100*time.Millisecond, "Round trip time of the simulated link")
+	size := flag.Int("size", 64<<20, "Bytes to transfer")
+	streams := flag.Int("streams", 1, "Concurrent streams sharing the transfer")
+	window := flag.Int("link-window", 6<<20, "Bytes in flight the link allows, like the TCP window")
+	var params transport.SmuxParams
+	flag.IntVar(&params.Version, "version", 2, "smux protocol version")
+	flag.IntVar(&params.MaxReceiveBuffer, "receive-buffer", 32<<20, "Session receive buffer in bytes")
+	flag.IntVar(&params.MaxStreamBuffer, "stream-buffer", 16<<20, "Stream window in bytes, version 2 only")
+	flag.IntVar(&params.MaxFrameSize, "frame-size", 32768, "Largest frame in bytes")
+	flag.Parse()
+
+	link := link{rtt: *rtt, window: *window}
+	fmt.Printf("Transferring %d MiB over %d stream(s), RTT %s, link window %d KiB\n", *size>>20, *streams, *rtt, *window>>10)
+	for _, run := range []struct {
+		name   string
+		params transport.SmuxParams
+	}{
+		{"defaults", transport.SmuxParams{}},
+		{"tuned", params},
+	} {
+		elapsed, err := measure(run.params, link, *size, *streams)
+		if err != nil {
+			log.Fatalf("%s: %v", run.name, err)
+		}
+		fmt.Printf("%-9s %8.1f MiB/s  (%s)\n", run.name, float64(*size)/(1<<20)/elapsed.Seconds(), elapsed.Round(time.Millisecond))
+	}
+}
+
+// measure sends size bytes from the receiver's end to the relay's end of a
+// session and returns how long it took until all of them arrived
+func measure(params transport.SmuxParams, link link, size, streams int) (time.Duration, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	relayErr := make(chan error, 1)
+	var relay transport.Session
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			relayErr <- err
+			return
+		}
+		relay, err = transport.SmuxServer(link.conn(conn), params)
+		relayErr <- err
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return 0, err
+	}
+	receiver, err := transport.SmuxClient(link.conn(conn), params)
+	if err != nil {
+		return 0, err
+	}
+	defer receiver.Close()
+	if err := <-relayErr; err != nil {
+		return 0, err
+	}
+	defer relay.Close()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*streams)
+	for i := range streams {
+		part := size / streams
+		if i == 0 {
+			part += size % streams
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			stream, err := receiver.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+			if _, err := io.CopyN(stream, zeros{}, int64(part)); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			stream, err := relay.AcceptStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+			if _, err := io.CopyN(io.Discard, stream, int64(part)); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// link simulates a network path: every write arrives after half the round
+// trip time, and at most window bytes are in flight. Bandwidth is unlimited,
+// so throughput is bound by windows and latency alone.
+type link struct {
+	rtt    time.Duration
+	window int
+}
+
+func (l link) conn(conn net.Conn) *delayConn {
+	// Keep loopback buffers from adding to the window
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetReadBuffer(linkSocketBuffer)
+		tcpConn.SetWriteBuffer(linkSocketBuffer)
+	}
+	c := &delayConn{
+		Conn:   conn,
+		delay:  l.rtt / 2,
+		window: l.window,
+		queue:  make(chan delayed, 1<<16),
+		done:   make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.deliver()
+	return c
+}
+
+const linkSocketBuffer = 128 << 10
+
+// delayConn is one direction of a link, writes are delivered by deliver
+type delayConn struct {
+	net.Conn
+	delay  time.Duration
+	window int
+	queue  chan delayed
+	done   chan struct{}
+	once   sync.Once
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inFlight int
+	closed   bool
+}
+
+type delayed struct {
+	data []byte
+	at   time.Time
+}
+
+func (c *delayConn) deliver() {
+	for {
+		select {
+		case d := <-c.queue:
+			time.Sleep(time.Until(d.at))
+			_, err := c.Conn.Write(d.data)
+			// The window opens once the acknowledgement made it back
+			time.AfterFunc(c.delay, func() {
+				c.mu.Lock()
+				c.inFlight -= len(d.data)
+				c.cond.Broadcast()
+				c.mu.Unlock()
+			})
+			if err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *delayConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	for c.inFlight > 0 && c.inFlight+len(b) > c.window && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.inFlight += len(b)
+	c.mu.Unlock()
+
+	select {
+	case c.queue <- delayed{data: bytes.Clone(b), at: time.Now().Add(c.delay)}:
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *delayConn) Close() error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
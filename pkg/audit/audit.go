@@ -0,0 +1,67 @@
+// Package audit keeps an append-only record of the relay's registrations and
+// transfers. Records never hold a token or credential, only their hashes, so
+// the audit log does not grant access to receivers.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Events of records
+const (
+	// A receiver registered or resumed a token
+	EventRegister = "register"
+	// A sender was piped to the receiver of a token
+	EventTransfer = "transfer"
+)
+
+// Outcomes of records
+const (
+	OutcomeRegistered = "registered"
+	OutcomeResumed    = "resumed"
+	// Both directions of the transfer finished
+	OutcomeCompleted = "completed"
+	// The relay dropped the transfer for its idle or total timeout
+	OutcomeIdleTimeout = "idle_timeout"
+	OutcomeTimeout     = "timeout"
+	// Copying failed, e.g. one side reset its connection
+	OutcomeFailed = "failed"
+	// The sender was turned away, e.g. over the tunnel's limits
+	OutcomeRefused = "refused"
+)
+
+// Receiver identifies who registered a token
+type Receiver struct {
+	// Hash of the auth token the receiver presented, empty without one
+	ID string `json:"receiver_id,omitempty"`
+	IP string `json:"receiver_ip"`
+}
+
+// Record is one entry of the audit log
+type Record struct {
+	Event     string `json:"event"`
+	TokenHash string `json:"token_hash"`
+	Intention string `json:"intention,omitempty"`
+	Shard     string `json:"shard,omitempty"`
+	Receiver
+	// Empty for registrations
+	SenderIP string    `json:"sender_ip,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	// Bytes the sender sent to the receiver and got back
+	BytesToReceiver int64  `json:"bytes_to_receiver"`
+	BytesToSender   int64  `json:"bytes_to_sender"`
+	Outcome         string `json:"outcome"`
+	Error           string `json:"error,omitempty"`
+}
+
+// Hash returns what records keep of a token or credential
+func Hash(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
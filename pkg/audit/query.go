@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Filter selects records, zero fields match all
+type Filter struct {
+	// Records that started in [Since, Until)
+	Since, Until time.Time
+	// Token of the records or its hash
+	Token string
+	// Receiver ID, receiver IP or sender IP. A credential is hashed to compare
+	// it with receiver IDs.
+	Identity string
+	Event    string
+}
+
+// Match reports whether r passes f
+func (f Filter) Match(r Record) bool {
+	if !f.Since.IsZero() && r.Start.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !r.Start.Before(f.Until) {
+		return false
+	}
+	if f.Token != "" && r.TokenHash != Hash(f.Token) && r.TokenHash != f.Token {
+		return false
+	}
+	if f.Identity != "" {
+		id := f.Identity
+		if r.Receiver.ID != id && r.Receiver.ID != Hash(id) && r.Receiver.IP != id && r.SenderIP != id {
+			return false
+		}
+	}
+	if f.Event != "" && r.Event != f.Event {
+		return false
+	}
+	return true
+}
+
+// Scan reads the JSON lines of an audit log from r and calls fn with the
+// records matching f, until fn returns an error
+func Scan(r io.Reader, f Filter, fn func(Record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if !f.Match(record) {
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
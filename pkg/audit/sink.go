@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Sink stores records. Write must be safe for concurrent use and have the
+// record stored durably by the time it returns.
+type Sink interface {
+	Write(Record) error
+	Close() error
+}
+
+// Discard is a Sink that drops records, for relays without an audit log
+var Discard Sink = discard{}
+
+type discard struct{}
+
+func (discard) Write(Record) error { return nil }
+func (discard) Close() error       { return nil }
+
+// FileSink appends records to a file as JSON lines, synced to disk one by
+// one
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenFile opens the audit log at path, creating it if needed
+func OpenFile(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Write(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// MultiSink writes records to all of sinks
+func MultiSink(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+type multiSink []Sink
+
+func (m multiSink) Write(r Record) error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.Write(r))
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiSink) Close() error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
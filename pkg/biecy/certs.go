@@ -1,52 +1,242 @@
 package biecy
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
-	"log"
+	"errors"
+	"fmt"
 	"math/big"
+	"strings"
 	"time"
 )
 
-func GenerateMinimalCA() ([]byte, *rsa.PrivateKey) {
-	caKey, _ := rsa.GenerateKey(rand.Reader, 1024)
-	caTemplate := &x509.Certificate{
-		SerialNumber:          big.NewInt(1),
+// KeyType selects the algorithm of generated keys
+type KeyType int
+
+const (
+	KeyECDSAP256 KeyType = iota
+	KeyEd25519
+)
+
+// DefaultLifetime is the validity of one-shot certificates, enough for a transfer
+const DefaultLifetime = 30 * time.Minute
+
+// Allowed clock skew between receiver and sender
+const clockSkew = time.Minute
+
+type options struct {
+	keyType  KeyType
+	lifetime time.Duration
+	dnsNames []string
+}
+
+// Option customizes certificate generation
+type Option func(*options)
+
+// WithKeyType sets the key algorithm, ECDSA P-256 by default
+func WithKeyType(keyType KeyType) Option {
+	return func(o *options) { o.keyType = keyType }
+}
+
+// WithLifetime sets how long certificates are valid, DefaultLifetime by
+// default. It must be positive.
+func WithLifetime(lifetime time.Duration) Option {
+	return func(o *options) { o.lifetime = lifetime }
+}
+
+// WithDNSNames adds DNS SANs to server certificates besides their domain.
+// Given to GenerateCA, the CA may issue for them too.
+func WithDNSNames(names ...string) Option {
+	return func(o *options) { o.dnsNames = append(o.dnsNames, names...) }
+}
+
+func newOptions(opts []Option) (options, error) {
+	o := options{keyType: KeyECDSAP256, lifetime: DefaultLifetime}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.lifetime <= 0 {
+		// The certificate would expire as it is issued
+		return o, fmt.Errorf("certificate lifetime must be positive, got %s", o.lifetime)
+	}
+	return o, nil
+}
+
+// CA is a short-lived certificate authority for one-shot server certificates
+type CA struct {
+	Cert    *x509.Certificate
+	CertPEM []byte
+	key     crypto.Signer
+}
+
+// ServerCert is a generated server certificate and its key
+type ServerCert struct {
+	Cert    *x509.Certificate
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// GenerateCA creates a new CA, restricted to issuing for the given domain
+// and the names of WithDNSNames
+func GenerateCA(domain string, opts ...Option) (*CA, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := generateKey(o.keyType)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
 		Subject:               pkix.Name{CommonName: "BieCA"},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageCertSign,
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(o.lifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		IsCA:                  true,
 		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		PermittedDNSDomains:   append([]string{domain}, o.dnsNames...),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
 	}
-	caBytes, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
-	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caBytes})
-	return caPEM, caKey
+
+	return &CA{
+		Cert:    cert,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:     key,
+	}, nil
 }
 
-func GenerateMinimalServerCert(caCert []byte, caKey *rsa.PrivateKey, domain string) ([]byte, []byte) {
-	serverKey, _ := rsa.GenerateKey(rand.Reader, 1024)
-	serverTemplate := &x509.Certificate{
-		SerialNumber: big.NewInt(2),
+// IssueServerCert issues a server certificate for domain, which is also its DNS SAN
+func (ca *CA) IssueServerCert(domain string, opts ...Option) (*ServerCert, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames := append([]string{domain}, o.dnsNames...)
+	for _, name := range dnsNames {
+		if !ca.permits(name) {
+			return nil, fmt.Errorf("CA may not issue for %q", name)
+		}
+	}
+
+	key, err := generateKey(o.keyType)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(o.lifetime)
+	if notAfter.After(ca.Cert.NotAfter) {
+		notAfter = ca.Cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
 		Subject:      pkix.Name{CommonName: domain},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     notAfter,
 		KeyUsage:     x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
-	block, _ := pem.Decode(caCert)
-	if block == nil {
-		log.Fatal("Failed to decode PEM block")
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal server key: %w", err)
 	}
-	caParsed, err := x509.ParseCertificate(block.Bytes)
+
+	return &ServerCert{
+		Cert:    cert,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// permits reports whether name is within the CA's name constraints, so
+// verifiers accept certificates for it
+func (ca *CA) permits(name string) bool {
+	if len(ca.Cert.PermittedDNSDomains) == 0 {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, permitted := range ca.Cert.PermittedDNSDomains {
+		permitted = strings.ToLower(permitted)
+		if name == permitted || strings.HasSuffix(name, "."+strings.TrimPrefix(permitted, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateServerCert creates a one-shot CA and issues a server certificate for domain
+func GenerateServerCert(domain string, opts ...Option) (*CA, *ServerCert, error) {
+	ca, err := GenerateCA(domain, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := ca.IssueServerCert(domain, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, cert, nil
+}
+
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyECDSAP256:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ECDSA key: %w", err)
+		}
+		return key, nil
+	case KeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate Ed25519 key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+}
+
+// randomSerial returns a random 128-bit serial number
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 	if err != nil {
-		log.Fatal("Failed to parse CA certificate:", err)
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
 	}
-	serverBytes, _ := x509.CreateCertificate(rand.Reader, serverTemplate, caParsed, &serverKey.PublicKey, caKey)
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverBytes})
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(serverKey)})
-	return certPEM, keyPEM
+	return serial, nil
 }
@@ -0,0 +1,51 @@
+package biecy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PinPrefix marks a SHA-256 public key pin, as used by curl's --pinnedpubkey
+const PinPrefix = "sha256//"
+
+// SPKIFingerprint returns the base64 SHA-256 of the certificate's SubjectPublicKeyInfo
+func SPKIFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Pin returns the public key pin of the certificate, e.g. "sha256//base64"
+func (c *ServerCert) Pin() string {
+	return PinPrefix + SPKIFingerprint(c.Cert)
+}
+
+// VerifyPin returns a tls.Config.VerifyConnection callback accepting only
+// peers whose leaf certificate matches pin. It is meant to be used with
+// InsecureSkipVerify, since one-shot certificates are not publicly trusted.
+func VerifyPin(pin string) (func(tls.ConnectionState) error, error) {
+	fingerprint, ok := strings.CutPrefix(pin, PinPrefix)
+	if !ok {
+		return nil, fmt.Errorf("pin must start with %q", PinPrefix)
+	}
+	want, err := base64.StdEncoding.DecodeString(fingerprint)
+	if err != nil || len(want) != sha256.Size {
+		return nil, errors.New("pin is not a base64 SHA-256 fingerprint")
+	}
+
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("peer sent no certificate")
+		}
+		got := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		if subtle.ConstantTimeCompare(got[:], want) != 1 {
+			return errors.New("peer public key does not match pin")
+		}
+		return nil
+	}, nil
+}
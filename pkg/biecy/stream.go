@@ -0,0 +1,228 @@
+package biecy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted stream format, independent of the TLS in between:
+//
+//	magic "bie1" | 16-byte salt | records...
+//
+// Each record is a 4-byte big-endian length, whose top bit marks the last
+// record, followed by an AES-256-GCM sealed chunk of at most StreamChunkSize
+// bytes. The stream key is derived from the shared key and the salt, and
+// nonces count records, so reordering, truncation and splicing are detected.
+
+const (
+	// StreamKeySize is the size of the shared key
+	StreamKeySize = 32
+	// StreamChunkSize is the maximum plaintext size of a record
+	StreamChunkSize = 64 * 1024
+
+	streamMagic = "bie1"
+	saltSize    = 16
+	lastRecord  = 1 << 31
+)
+
+var (
+	errNotEncrypted = errors.New("data is not a bie encrypted stream")
+	errTruncated    = errors.New("encrypted stream is truncated")
+	errTrailingData = errors.New("data after the end of the encrypted stream")
+	errCorrupted    = errors.New("encrypted stream is corrupted or the key is wrong")
+)
+
+// NewStreamKey returns a random key for an encrypted stream
+func NewStreamKey() ([]byte, error) {
+	key := make([]byte, StreamKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// FormatStreamKey encodes the key for a URL fragment
+func FormatStreamKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// ParseStreamKey decodes a key encoded by FormatStreamKey
+func ParseStreamKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != StreamKeySize {
+		return nil, errors.New("invalid stream key")
+	}
+	return key, nil
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// EncryptWriter returns a writer encrypting into w. Close must be called to
+// write the final record, it does not close w.
+func EncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := streamAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append([]byte(streamMagic), salt...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed encrypted stream")
+	}
+
+	e.buf = append(e.buf, p...)
+	// Keep the tail buffered, it may turn out to be the last record
+	for len(e.buf) > StreamChunkSize {
+		if err := e.seal(e.buf[:StreamChunkSize], false); err != nil {
+			return 0, err
+		}
+		e.buf = e.buf[StreamChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(e.buf, true)
+}
+
+func (e *encryptWriter) seal(chunk []byte, last bool) error {
+	sealed := e.aead.Seal(nil, recordNonce(e.counter, last), chunk, nil)
+	e.counter++
+
+	length := uint32(len(sealed))
+	if last {
+		length |= lastRecord
+	}
+	if err := binary.Write(e.w, binary.BigEndian, length); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+// DecryptReader returns a reader decrypting a stream written by EncryptWriter.
+// It fails if the stream was tampered with or ends early.
+func DecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	header := make([]byte, len(streamMagic)+saltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errNotEncrypted
+	}
+	if !bytes.Equal(header[:len(streamMagic)], []byte(streamMagic)) {
+		return nil, errNotEncrypted
+	}
+
+	aead, err := streamAEAD(key, header[len(streamMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, aead: aead}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			// Make sure nothing was appended after the last record
+			var extra [1]byte
+			if n, _ := d.r.Read(extra[:]); n > 0 {
+				return 0, errTrailingData
+			}
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	var length uint32
+	if err := binary.Read(d.r, binary.BigEndian, &length); err != nil {
+		return errTruncated
+	}
+	last := length&lastRecord != 0
+	length &^= lastRecord
+	if length > StreamChunkSize+uint32(d.aead.Overhead()) {
+		return errCorrupted
+	}
+
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return errTruncated
+	}
+	chunk, err := d.aead.Open(sealed[:0], recordNonce(d.counter, last), sealed, nil)
+	if err != nil {
+		return errCorrupted
+	}
+	d.counter++
+
+	d.buf = chunk
+	d.done = last
+	return nil
+}
+
+func streamAEAD(key, salt []byte) (cipher.AEAD, error) {
+	if len(key) != StreamKeySize {
+		return nil, fmt.Errorf("stream key must be %d bytes", StreamKeySize)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("bie stream v1"))
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// recordNonce is the record counter followed by the last-record flag
+func recordNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
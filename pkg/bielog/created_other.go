@@ -0,0 +1,14 @@
+//go:build !linux
+
+package bielog
+
+import (
+	"os"
+	"time"
+)
+
+// created returns the modification time of the file at path, the creation
+// time is not available everywhere
+func created(path string, info os.FileInfo) time.Time {
+	return info.ModTime()
+}
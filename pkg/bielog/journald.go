@@ -0,0 +1,69 @@
+package bielog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+)
+
+// Where journald takes records in its native protocol
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldWriter sends records to the systemd journal, one datagram each
+type journaldWriter struct {
+	conn *net.UnixConn
+	tag  string
+	buf  bytes.Buffer
+}
+
+func dialJournald(tag string) (*journaldWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{conn: conn, tag: tag}, nil
+}
+
+// WriteRecord is called by one recordHandler at a time
+func (j *journaldWriter) WriteRecord(level slog.Level, line []byte) error {
+	j.buf.Reset()
+	j.field("PRIORITY", []byte{journaldPriority(level)})
+	if j.tag != "" {
+		j.field("SYSLOG_IDENTIFIER", []byte(j.tag))
+	}
+	j.field("MESSAGE", line)
+	_, err := j.conn.Write(j.buf.Bytes())
+	return err
+}
+
+// field appends a field of the native protocol, values with a newline need
+// its length-prefixed form
+func (j *journaldWriter) field(name string, value []byte) {
+	j.buf.WriteString(name)
+	if bytes.IndexByte(value, '\n') < 0 {
+		j.buf.WriteByte('=')
+	} else {
+		j.buf.WriteByte('\n')
+		binary.Write(&j.buf, binary.LittleEndian, uint64(len(value)))
+	}
+	j.buf.Write(value)
+	j.buf.WriteByte('\n')
+}
+
+// journaldPriority returns the syslog priority of level as a digit
+func journaldPriority(level slog.Level) byte {
+	switch {
+	case level >= slog.LevelError:
+		return '3'
+	case level >= slog.LevelWarn:
+		return '4'
+	case level >= slog.LevelInfo:
+		return '6'
+	}
+	return '7'
+}
+
+func (j *journaldWriter) Close() error {
+	return j.conn.Close()
+}
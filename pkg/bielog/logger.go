@@ -2,36 +2,101 @@ package bielog
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 )
 
 type LoggerCtxKey struct{}
 
-func NewLogger(loggerType string, logLevel string, handlerOpts *slog.HandlerOptions) *slog.Logger {
-	var handler slog.Handler
+// Config selects the format and destinations of a logger
+type Config struct {
+	// Record format: "text" or "json"
+	Type string
+	// Lowest level logged: "debug", "info", "warn" or "error"
+	Level string
+	// Where records go, all of them get each record: "stdout", "stderr",
+	// "file", "syslog" or "journald". Empty is stdout.
+	Sinks []string
+	// Path of the "file" sink
+	File string
+	// The file is rotated when it would grow past MaxSize bytes or has been
+	// open for MaxAge, zero disables either. Rotated files get a timestamp
+	// suffix and only the newest MaxBackups are kept, 0 keeps all.
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	// Address of the "syslog" sink like "udp://host:514" or
+	// "unix:///dev/log", empty is the local syslog daemon
+	SyslogAddr string
+	// Program name of syslog and journald records
+	Tag string
+	// Thins out repeated records, see Sampling
+	Sampling Sampling
+}
 
-	level := parseLogLevel(logLevel)
+// Sampling bounds how often the same message is logged. Records with the same
+// level and message are counted per Interval: the first First of them are
+// logged, then every Thereafter-th, 0 drops the rest. The next record logged
+// counts the dropped ones in "sampled_out". Errors are never dropped.
+type Sampling struct {
+	// Zero disables sampling
+	Interval          time.Duration
+	First, Thereafter int
+	// Prefixes of the messages sampled, empty samples all messages
+	Messages []string
+}
+
+// NewLogger builds the logger cfg describes. Close the returned closer to
+// flush and release its files and connections.
+func NewLogger(cfg Config, handlerOpts *slog.HandlerOptions) (*slog.Logger, io.Closer, error) {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Type != "text" && cfg.Type != "json" {
+		return nil, nil, fmt.Errorf("unknown log type %q, want text or json", cfg.Type)
+	}
+	if cfg.Sampling.Interval < 0 || cfg.Sampling.First < 0 || cfg.Sampling.Thereafter < 0 {
+		return nil, nil, errors.New("log sampling settings must not be negative")
+	}
 
 	var resultingOpts slog.HandlerOptions
 	if handlerOpts != nil {
 		resultingOpts = *handlerOpts
-	} else {
-		resultingOpts = slog.HandlerOptions{}
 	}
 	resultingOpts.Level = level
 
-	switch loggerType {
-	case "json":
-		handler = slog.NewJSONHandler(os.Stdout, &resultingOpts)
-	case "text":
-		handler = slog.NewTextHandler(os.Stdout, &resultingOpts)
-	default:
-		handler = slog.NewTextHandler(os.Stdout, &resultingOpts)
+	sinks := cfg.Sinks
+	if len(sinks) == 0 {
+		sinks = []string{"stdout"}
+	}
+	var handlers []slog.Handler
+	var closers closers
+	for _, sink := range sinks {
+		handler, closer, err := openSink(sink, cfg, resultingOpts)
+		if err != nil {
+			closers.Close()
+			return nil, nil, err
+		}
+		handlers = append(handlers, handler)
+		if closer != nil {
+			closers = append(closers, closer)
+		}
 	}
 
-	return slog.New(handler)
+	var handler slog.Handler = handlers[0]
+	if len(handlers) > 1 {
+		handler = &multiHandler{handlers: handlers}
+	}
+	if cfg.Sampling.Interval > 0 {
+		handler = newSamplingHandler(handler, cfg.Sampling)
+	}
+	return slog.New(&traceHandler{next: handler}), closers, nil
 }
 
 func FromCtx(ctx context.Context) *slog.Logger {
@@ -47,17 +112,28 @@ func CtxWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
 }
 
 // parseLogLevel converts a string to slog.Level
-func parseLogLevel(levelStr string) slog.Level {
+func parseLogLevel(levelStr string) (slog.Level, error) {
 	switch strings.ToLower(levelStr) {
 	case "debug":
-		return slog.LevelDebug
+		return slog.LevelDebug, nil
 	case "info":
-		return slog.LevelInfo
+		return slog.LevelInfo, nil
 	case "warn":
-		return slog.LevelWarn
+		return slog.LevelWarn, nil
 	case "error":
-		return slog.LevelError
+		return slog.LevelError, nil
 	default:
-		return slog.LevelInfo // Default level
+		return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", levelStr)
+	}
+}
+
+// closers closes all of them
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var errs []error
+	for _, closer := range c {
+		errs = append(errs, closer.Close())
 	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,149 @@
+package bielog
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Suffix of rotated files, sorts by time
+const rotatedSuffix = "20060102T150405.000"
+
+// rotatingFile appends to a file and moves it aside when it gets too big or
+// too old, see Config
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	closed bool
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	if maxSize < 0 || maxAge < 0 || maxBackups < 0 {
+		return nil, errors.New("log file rotation settings must not be negative")
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	// Appending to an existing file, its age counts from its creation,
+	// not from the relay's start
+	opened := time.Now()
+	if info.Size() > 0 {
+		opened = created(f.path, info)
+	}
+	f.file, f.size, f.opened = file, info.Size(), opened
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		// A rotation failed to open the new file, try again
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.due(len(b)) {
+		// With the old file kept the record goes there, the next write
+		// retries the rotation
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file has to be rotated before writing n bytes.
+// An empty file is not, records bigger than maxSize get a file of their own.
+func (f *rotatingFile) due(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	return (f.maxSize > 0 && f.size+int64(n) > f.maxSize) ||
+		(f.maxAge > 0 && time.Since(f.opened) >= f.maxAge)
+}
+
+// rotate moves the file aside and opens a new one. If the move fails the old
+// file is opened again, if opening fails f.file is left nil.
+func (f *rotatingFile) rotate() error {
+	closeErr := f.file.Close()
+	f.file = nil
+	rotated := f.path + "." + time.Now().UTC().Format(rotatedSuffix)
+	renameErr := os.Rename(f.path, rotated)
+	if err := f.open(); err != nil {
+		return errors.Join(closeErr, renameErr, err)
+	}
+	if renameErr != nil {
+		// Still the old file, its age keeps the rotation due
+		return renameErr
+	}
+	return f.prune()
+}
+
+// prune deletes the oldest rotated files beyond maxBackups
+func (f *rotatingFile) prune() error {
+	if f.maxBackups == 0 {
+		return nil
+	}
+	var backups []string
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		suffix := match[len(f.path)+1:]
+		if _, err := time.Parse(rotatedSuffix, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	slices.Sort(backups)
+	var errs []error
+	for len(backups) > f.maxBackups {
+		errs = append(errs, os.Remove(backups[0]))
+		backups = backups[1:]
+	}
+	return errors.Join(errs...)
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed || f.file == nil {
+		f.closed = true
+		return nil
+	}
+	err := f.file.Close()
+	f.file, f.closed = nil, true
+	return err
+}
@@ -0,0 +1,108 @@
+package bielog
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// samplingHandler drops repeated records before they reach next, see Sampling
+type samplingHandler struct {
+	next    slog.Handler
+	sampler *sampler
+}
+
+// sampler is shared by a samplingHandler and those derived from it
+type sampler struct {
+	Sampling
+
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+}
+
+type sampleKey struct {
+	level slog.Level
+	msg   string
+}
+
+// Records of one key in the current interval
+type sampleCount struct {
+	start   time.Time
+	seen    int
+	dropped int
+}
+
+func newSamplingHandler(next slog.Handler, sampling Sampling) *samplingHandler {
+	return &samplingHandler{next: next, sampler: &sampler{Sampling: sampling, counts: make(map[sampleKey]*sampleCount)}}
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	keep, dropped := h.sampler.sample(r)
+	if !keep {
+		return nil
+	}
+	if dropped > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("sampled_out", dropped))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{next: h.next.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{next: h.next.WithGroup(name), sampler: h.sampler}
+}
+
+// sample reports whether r is logged, and how many records like it were
+// dropped since the last one logged
+func (s *sampler) sample(r slog.Record) (keep bool, dropped int) {
+	if r.Level >= slog.LevelError || !s.matches(r.Message) {
+		return true, 0
+	}
+	now := r.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sampleKey{level: r.Level, msg: r.Message}
+	count := s.counts[key]
+	if count == nil {
+		count = &sampleCount{start: now}
+		s.counts[key] = count
+	} else if now.Sub(count.start) >= s.Interval {
+		count.start, count.seen = now, 0
+	}
+	count.seen++
+
+	n := count.seen - s.First
+	if n > 0 && (s.Thereafter == 0 || n%s.Thereafter != 0) {
+		count.dropped++
+		return false, 0
+	}
+	dropped, count.dropped = count.dropped, 0
+	return true, dropped
+}
+
+func (s *sampler) matches(msg string) bool {
+	if len(s.Messages) == 0 {
+		return true
+	}
+	for _, prefix := range s.Messages {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
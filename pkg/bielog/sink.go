@@ -0,0 +1,151 @@
+package bielog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// openSink returns the handler writing records to sink, and what to close
+// when done with it
+func openSink(sink string, cfg Config, opts slog.HandlerOptions) (slog.Handler, io.Closer, error) {
+	switch sink {
+	case "stdout":
+		return newFormatHandler(cfg.Type, os.Stdout, &opts), nil, nil
+	case "stderr":
+		return newFormatHandler(cfg.Type, os.Stderr, &opts), nil, nil
+	case "file":
+		if cfg.File == "" {
+			return nil, nil, errors.New("file log sink needs a file path")
+		}
+		file, err := openRotatingFile(cfg.File, cfg.MaxSize, cfg.MaxAge, cfg.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newFormatHandler(cfg.Type, file, &opts), file, nil
+	case "syslog":
+		w, err := dialSyslog(cfg.SyslogAddr, cfg.Tag)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		return newRecordHandler(cfg.Type, w, opts), w, nil
+	case "journald":
+		w, err := dialJournald(cfg.Tag)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to journald: %w", err)
+		}
+		return newRecordHandler(cfg.Type, w, opts), w, nil
+	}
+	return nil, nil, fmt.Errorf("unknown log sink %q, want stdout, stderr, file, syslog or journald", sink)
+}
+
+func newFormatHandler(loggerType string, w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+	if loggerType == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// recordWriter takes one formatted record at a time along with its level,
+// like syslog and journald, which set a priority on each message
+type recordWriter interface {
+	WriteRecord(level slog.Level, line []byte) error
+	io.Closer
+}
+
+// recordHandler formats records and hands them to a recordWriter one by one
+type recordHandler struct {
+	format slog.Handler
+	state  *recordState
+}
+
+// recordState is shared by a recordHandler and those derived from it
+type recordState struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	w   recordWriter
+}
+
+func newRecordHandler(loggerType string, w recordWriter, opts slog.HandlerOptions) *recordHandler {
+	state := &recordState{w: w}
+	// The receiving daemon timestamps records itself
+	replace := opts.ReplaceAttr
+	opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		if replace != nil {
+			return replace(groups, a)
+		}
+		return a
+	}
+	return &recordHandler{format: newFormatHandler(loggerType, &state.buf, &opts), state: state}
+}
+
+func (h *recordHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.format.Enabled(ctx, level)
+}
+
+func (h *recordHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+
+	h.state.buf.Reset()
+	if err := h.format.Handle(ctx, r); err != nil {
+		return err
+	}
+	return h.state.w.WriteRecord(r.Level, bytes.TrimSuffix(h.state.buf.Bytes(), []byte("\n")))
+}
+
+func (h *recordHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &recordHandler{format: h.format.WithAttrs(attrs), state: h.state}
+}
+
+func (h *recordHandler) WithGroup(name string) slog.Handler {
+	return &recordHandler{format: h.format.WithGroup(name), state: h.state}
+}
+
+// multiHandler passes each record to all of its handlers
+type multiHandler struct {
+	handlers []slog.Handler
+}
+
+func (h *multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, r.Level) {
+			errs = append(errs, handler.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return &multiHandler{handlers: handlers}
+}
+
+func (h *multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, len(h.handlers))
+	for i, handler := range h.handlers {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return &multiHandler{handlers: handlers}
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package bielog
+
+import "errors"
+
+func dialSyslog(addr, tag string) (recordWriter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
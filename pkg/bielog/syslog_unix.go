@@ -0,0 +1,43 @@
+//go:build !windows && !plan9
+
+package bielog
+
+import (
+	"log/slog"
+	"log/syslog"
+	"strings"
+)
+
+// syslogWriter sends records to a syslog daemon with the priority of their
+// level
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+// dialSyslog connects to addr, "network://address" or empty for the local
+// daemon
+func dialSyslog(addr, tag string) (*syslogWriter, error) {
+	network, raddr, _ := strings.Cut(addr, "://")
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (s *syslogWriter) WriteRecord(level slog.Level, line []byte) error {
+	msg := string(line)
+	switch {
+	case level >= slog.LevelError:
+		return s.w.Err(msg)
+	case level >= slog.LevelWarn:
+		return s.w.Warning(msg)
+	case level >= slog.LevelInfo:
+		return s.w.Info(msg)
+	}
+	return s.w.Debug(msg)
+}
+
+func (s *syslogWriter) Close() error {
+	return s.w.Close()
+}
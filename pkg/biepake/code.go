@@ -0,0 +1,57 @@
+package biepake
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CodeWords is the number of password words in a transfer code
+const CodeWords = 2
+
+// Code is a short transfer code like "7-crossword-banana". The nameplate is
+// assigned by the relay to find the receiver, the words are the password
+// and never leave the two peers.
+type Code struct {
+	Nameplate string
+	Password  string
+}
+
+// NewPassword returns random password words joined by dashes
+func NewPassword() (string, error) {
+	random := make([]byte, CodeWords)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	parts := make([]string, CodeWords)
+	for i, b := range random {
+		parts[i] = words[b]
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// ParseCode splits a transfer code into its nameplate and password
+func ParseCode(code string) (Code, error) {
+	nameplate, password, ok := strings.Cut(strings.ToLower(strings.TrimSpace(code)), "-")
+	if !ok || nameplate == "" || password == "" {
+		return Code{}, errors.New("code must look like 7-crossword-banana")
+	}
+	for _, c := range nameplate {
+		if c < '0' || c > '9' {
+			return Code{}, fmt.Errorf("invalid nameplate %q", nameplate)
+		}
+	}
+	return Code{Nameplate: nameplate, Password: password}, nil
+}
+
+// String returns the code as typed by users
+func (c Code) String() string {
+	return c.Nameplate + "-" + c.Password
+}
+
+// SessionID binds the exchange to the nameplate it runs under
+func (c Code) SessionID() []byte {
+	return []byte("bie/" + c.Nameplate)
+}
@@ -0,0 +1,91 @@
+package biepake
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"bie/pkg/biewire"
+)
+
+// ErrWrongCode is returned when the peer used a different transfer code
+var ErrWrongCode = errors.New("wrong transfer code")
+
+type exchangeMsg struct {
+	Msg []byte `json:"msg"`
+}
+
+type confirmMsg struct {
+	Tag []byte `json:"tag"`
+}
+
+type pinMsg struct {
+	Pin string `json:"pin"`
+	Tag []byte `json:"tag"`
+}
+
+// SenderHandshake runs the sender's side of the exchange over rw and returns
+// the receiver's certificate pin, authenticated by the code
+func SenderHandshake(rw io.ReadWriter, code Code) (string, error) {
+	exchange, msg, err := Start([]byte(code.Password), code.SessionID())
+	if err != nil {
+		return "", err
+	}
+	if err := biewire.SendJSON(rw, exchangeMsg{Msg: msg}); err != nil {
+		return "", fmt.Errorf("failed to send PAKE message: %w", err)
+	}
+
+	var peer exchangeMsg
+	if err := biewire.ReceiveJSON(rw, &peer); err != nil {
+		return "", fmt.Errorf("failed to receive PAKE message: %w", err)
+	}
+	session, err := exchange.Finish(peer.Msg)
+	if err != nil {
+		return "", err
+	}
+
+	if err := biewire.SendJSON(rw, confirmMsg{Tag: session.Tag(nil)}); err != nil {
+		return "", fmt.Errorf("failed to send key confirmation: %w", err)
+	}
+
+	// The receiver hangs up instead of answering when the code was wrong
+	var pin pinMsg
+	if err := biewire.ReceiveJSON(rw, &pin); err != nil {
+		return "", ErrWrongCode
+	}
+	if !session.Verify([]byte(pin.Pin), pin.Tag) {
+		return "", ErrWrongCode
+	}
+	return pin.Pin, nil
+}
+
+// ReceiverHandshake runs the receiver's side of the exchange over rw and,
+// once the sender proved it knows the code, sends it the certificate pin
+func ReceiverHandshake(rw io.ReadWriter, code Code, pin string) error {
+	var peer exchangeMsg
+	if err := biewire.ReceiveJSON(rw, &peer); err != nil {
+		return fmt.Errorf("failed to receive PAKE message: %w", err)
+	}
+
+	exchange, msg, err := Start([]byte(code.Password), code.SessionID())
+	if err != nil {
+		return err
+	}
+	if err := biewire.SendJSON(rw, exchangeMsg{Msg: msg}); err != nil {
+		return fmt.Errorf("failed to send PAKE message: %w", err)
+	}
+	session, err := exchange.Finish(peer.Msg)
+	if err != nil {
+		return err
+	}
+
+	var confirm confirmMsg
+	if err := biewire.ReceiveJSON(rw, &confirm); err != nil {
+		return fmt.Errorf("failed to receive key confirmation: %w", err)
+	}
+	if !session.Verify(nil, confirm.Tag) {
+		return ErrWrongCode
+	}
+
+	return biewire.SendJSON(rw, pinMsg{Pin: pin, Tag: session.Tag([]byte(pin))})
+}
@@ -0,0 +1,120 @@
+package biepake
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+
+	"github.com/gtank/ristretto255"
+)
+
+// CPace over ristretto255: both sides derive the generator from the password,
+// exchange one element each and end up with the same key only if their
+// passwords matched. A man in the middle gets a single online guess per
+// exchange and nothing to brute force offline.
+
+const (
+	dsi    = "CPaceRistretto255"
+	dsiISK = "CPaceRistretto255_ISK"
+	// KeySize is the size of the derived session key
+	KeySize = 32
+)
+
+var errInvalidElement = errors.New("invalid PAKE message")
+
+// Exchange is one side of a key exchange in progress
+type Exchange struct {
+	sid    []byte
+	scalar *ristretto255.Scalar
+	msg    []byte
+}
+
+// Session is the result of a completed exchange
+type Session struct {
+	Key     []byte
+	ownMsg  []byte
+	peerMsg []byte
+}
+
+// Start begins an exchange for password, bound to the session id sid which
+// both sides must agree on. The returned message is sent to the peer.
+func Start(password, sid []byte) (*Exchange, []byte, error) {
+	generator := hashToElement(password, sid)
+
+	random := make([]byte, 64)
+	if _, err := rand.Read(random); err != nil {
+		return nil, nil, err
+	}
+	scalar := ristretto255.NewScalar().FromUniformBytes(random)
+
+	element := ristretto255.NewElement().ScalarMult(scalar, generator)
+	msg := element.Encode(nil)
+
+	return &Exchange{sid: sid, scalar: scalar, msg: msg}, msg, nil
+}
+
+// Finish completes the exchange with the peer's message
+func (e *Exchange) Finish(peerMsg []byte) (*Session, error) {
+	peer := ristretto255.NewElement()
+	if err := peer.Decode(peerMsg); err != nil {
+		return nil, errInvalidElement
+	}
+	identity := ristretto255.NewElement().Zero()
+	if peer.Equal(identity) == 1 {
+		return nil, errInvalidElement
+	}
+
+	shared := ristretto255.NewElement().ScalarMult(e.scalar, peer)
+	if shared.Equal(identity) == 1 {
+		return nil, errInvalidElement
+	}
+
+	// Order the transcript so both sides hash the same bytes regardless of role
+	first, second := e.msg, peerMsg
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	h := sha512.New()
+	h.Write(lengthValue([]byte(dsiISK), e.sid, shared.Encode(nil), first, second))
+
+	return &Session{
+		Key:     h.Sum(nil)[:KeySize],
+		ownMsg:  e.msg,
+		peerMsg: peerMsg,
+	}, nil
+}
+
+// Tag authenticates data as coming from us, proving we know the key
+func (s *Session) Tag(data []byte) []byte {
+	return tag(s.Key, s.ownMsg, data)
+}
+
+// Verify checks that tag was made by the peer over data
+func (s *Session) Verify(data, mac []byte) bool {
+	return hmac.Equal(tag(s.Key, s.peerMsg, data), mac)
+}
+
+func tag(key, sender, data []byte) []byte {
+	mac := hmac.New(sha512.New512_256, key)
+	mac.Write(lengthValue(sender, data))
+	return mac.Sum(nil)
+}
+
+func hashToElement(password, sid []byte) *ristretto255.Element {
+	h := sha512.New()
+	h.Write(lengthValue([]byte(dsi), password, sid))
+	return ristretto255.NewElement().FromUniformBytes(h.Sum(nil))
+}
+
+// lengthValue concatenates the values, each prefixed with its length
+func lengthValue(values ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buf, binary.BigEndian, uint32(len(v)))
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
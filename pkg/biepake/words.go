@@ -0,0 +1,39 @@
+package biepake
+
+// words encode one byte each, so a code with two words carries 16 bits of password
+var words = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alpha",
+	"amber", "angle", "ankle", "apple", "apron", "arena", "argue", "armor",
+	"arrow", "atlas", "attic", "audio", "autumn", "bacon", "badge", "bagel",
+	"baker", "bamboo", "banana", "banjo", "barn", "basil", "basket", "beach",
+	"beaver", "berry", "bingo", "blanket", "boat", "bonfire", "border",
+	"bottle", "bounce", "bracket", "branch", "bread", "breeze", "brick",
+	"bridge", "bubble", "bucket", "buffalo", "bundle", "butter", "cabin",
+	"cactus", "camera", "camel", "candle", "canoe", "canyon", "carbon",
+	"carpet", "carrot", "castle", "cedar", "cello", "chalk", "cherry", "chess",
+	"cider", "cinema", "circus", "citrus", "clover", "cobalt", "cocoa", "comet",
+	"compass", "copper", "coral", "cotton", "cousin", "coyote", "crater",
+	"crayon", "cricket", "crossword", "crystal", "cube", "curtain", "cycle",
+	"daisy", "dance", "delta", "denim", "desert", "diamond", "dinner",
+	"dolphin", "domino", "donkey", "dragon", "dream", "drum", "eagle", "easel",
+	"echo", "eclipse", "elbow", "ember", "engine", "falcon", "fanfare",
+	"feather", "fern", "fiddle", "finch", "fjord", "flame", "flute", "forest",
+	"fossil", "fox", "galaxy", "garden", "garlic", "ginger", "giraffe",
+	"glacier", "globe", "goblet", "gold", "gravel", "guitar", "hammer",
+	"harbor", "harvest", "hazel", "helmet", "heron", "hollow", "honey", "husky",
+	"igloo", "island", "ivory", "jacket", "jaguar", "jelly", "jigsaw", "jungle",
+	"kayak", "kernel", "kettle", "kitten", "koala", "ladder", "lagoon",
+	"lantern", "lemon", "lily", "lizard", "llama", "lotus", "magnet", "mango",
+	"maple", "marble", "meadow", "melon", "meteor", "mint", "mirror", "mitten",
+	"monkey", "mosaic", "muffin", "napkin", "nectar", "needle", "noodle",
+	"nutmeg", "oasis", "ocean", "olive", "onion", "orange", "orbit", "orchid",
+	"otter", "oyster", "paddle", "panda", "papaya", "parrot", "pasta", "peach",
+	"peanut", "pebble", "pepper", "piano", "pickle", "pillow", "pilot", "pizza",
+	"planet", "plum", "pocket", "polka", "potato", "prism", "pumpkin", "puzzle",
+	"quartz", "quilt", "rabbit", "radar", "radish", "raven", "ribbon", "river",
+	"robot", "rocket", "saddle", "salmon", "sandal", "satin", "scarf", "shadow",
+	"signal", "silver", "sketch", "spider", "sponge", "squash", "stamp",
+	"summit", "sunset", "swan", "tango", "tiger", "toast", "tomato", "topaz",
+	"tulip", "tunnel", "turtle", "velvet", "violin", "waffle", "walnut",
+	"walrus", "willow", "window", "wizard", "yogurt", "zebra",
+}
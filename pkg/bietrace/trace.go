@@ -0,0 +1,131 @@
+// Package bietrace sets up OpenTelemetry tracing for bie and carries trace
+// context between CLI and relay, so the spans of both join one trace.
+package bietrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of bie's tracer
+const instrumentation = "bie"
+
+// Config selects where spans go
+type Config struct {
+	// OTLP/HTTP endpoint like http://localhost:4318, empty disables tracing
+	// unless Exporter is set
+	Endpoint string
+	// service.name of the spans
+	ServiceName string
+	// Fraction of new traces recorded, traces continued from a parent follow
+	// its decision. Zero records all.
+	SampleRatio float64
+	// Exports spans here instead of Endpoint, e.g. an in-memory exporter of
+	// go.opentelemetry.io/otel/sdk/trace/tracetest
+	Exporter sdktrace.SpanExporter
+}
+
+// Enabled reports whether cfg records spans
+func (cfg Config) Enabled() bool {
+	return cfg.Endpoint != "" || cfg.Exporter != nil
+}
+
+// Setup installs the global tracer provider cfg describes and W3C trace
+// context propagation. Call shutdown to flush the spans still buffered. With
+// tracing disabled spans are not recorded and shutdown does nothing.
+func Setup(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	noop := func(context.Context) error { return nil }
+	if !cfg.Enabled() {
+		return noop, nil
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return noop, fmt.Errorf("trace sample ratio %v is not between 0 and 1", cfg.SampleRatio)
+	}
+
+	exporter := cfg.Exporter
+	if exporter == nil {
+		if exporter, err = otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.Endpoint)); err != nil {
+			return noop, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+	}
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+	if err != nil {
+		return noop, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Tracer returns bie's tracer of the global tracer provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// Inject returns the W3C traceparent of the span in ctx, empty without one
+func Inject(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Extract returns ctx with the remote span of traceparent as the parent of
+// new spans. Invalid or empty ones leave ctx as is.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
+
+// InjectHeader adds the traceparent of the span in ctx to an HTTP request's
+// header
+func InjectHeader(ctx context.Context, header http.Header) {
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// LinkFromHeader returns a link to the span of the traceparent in header, for
+// spans serving a request of another trace
+func LinkFromHeader(header http.Header) (trace.Link, bool) {
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(header))
+	spanContext := trace.SpanContextFromContext(ctx)
+	return trace.Link{SpanContext: spanContext}, spanContext.IsValid()
+}
+
+// TraceID returns the ID of the trace in ctx, empty without one
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// End ends span, marking it failed with err if any
+func End(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, context.Canceled) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
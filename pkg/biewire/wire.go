@@ -9,10 +9,58 @@ const (
 type ClientRequest struct {
 	AuthToken string `json:"auth_token"`
 	Intention string `json:"intention"`
+	// Receiver asks for a short nameplate to build a transfer code
+	Code bool `json:"code,omitempty"`
+	// Sender joins the receiver holding this nameplate
+	Nameplate string `json:"nameplate,omitempty"`
+	// Limits of senders of a tunnel, lowered to the relay's own. 0 leaves
+	// them to the relay.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+	MaxTotal      int `json:"max_total,omitempty"`
+	// Receiver lets the relay terminate the TLS of its senders with the
+	// relay's certificate and gets their plain traffic
+	RelayTLS bool `json:"relay_tls,omitempty"`
+	// Receiver reconnects to the registration of this token, proven by the
+	// secret it got when registering
+	ResumeToken  string `json:"resume_token,omitempty"`
+	ResumeSecret string `json:"resume_secret,omitempty"`
+	// Receiver frames its smux streams to pass half-closes, see
+	// transport.WithHalfClose
+	HalfClose bool `json:"half_close,omitempty"`
+	// Finished transfer of an IntentionReport
+	Transfer *TransferReport `json:"transfer,omitempty"`
+	// W3C traceparent of the client's span, the relay's spans join its trace
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// TransferReport is a receiver's account of a finished transfer
+type TransferReport struct {
+	// Bytes of the file as they came in, compressed with Encoding if any,
+	// and as written
+	Bytes        int64  `json:"bytes"`
+	LogicalBytes int64  `json:"logical_bytes"`
+	Encoding     string `json:"encoding,omitempty"`
 }
 
 type ClientResponse struct {
-	Token string `json:"token"`
+	Token     string `json:"token"`
+	Nameplate string `json:"nameplate,omitempty"`
+	// Secret to resume the registration after reconnecting
+	ResumeSecret string `json:"resume_secret,omitempty"`
+	// Relay agreed on the receiver's HalfClose
+	HalfClose bool `json:"half_close,omitempty"`
+	// Relay accepts IntentionReport streams from the receiver
+	TransferReports bool   `json:"transfer_reports,omitempty"`
+	Error           string `json:"error,omitempty"`
 }
 
 // Intention can be send or get for example
+const (
+	IntentionGet  = "get"
+	IntentionSend = "send"
+	// Receiver stays registered and gets a new stream per sender, used by
+	// tunnels and file serving
+	IntentionTunnel = "tunnel"
+	// Receiver reports a finished transfer on a new stream of its session
+	IntentionReport = "report"
+)
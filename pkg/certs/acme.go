@@ -0,0 +1,190 @@
+package certs
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig configures the ACME certificate provider
+type ACMEConfig struct {
+	// Domain served to clients without SNI
+	Domain string
+	// More domains to obtain certificates for, picked by SNI
+	ExtraDomains []string
+	Email        string
+	// Directory for the on-disk certificate and account cache
+	CacheDir string
+	// ACME directory, Let's Encrypt production when empty
+	DirectoryURL string
+	// Extra PEM root to trust when talking to the directory (e.g. Pebble's)
+	CARootFile string
+	// Address to answer HTTP-01 challenges on, the only challenge answered:
+	// TLS-ALPN-01 would need port 443, where the relay passes senders through
+	HTTPAddr string
+	// How long before expiry certificates are renewed
+	RenewBefore time.Duration
+}
+
+// ACMEProvider obtains and renews certificates from an ACME CA on its own
+type ACMEProvider struct {
+	cfg     ACMEConfig
+	manager *autocert.Manager
+	httpSrv *http.Server
+	logger  Logger
+}
+
+// NewACMEProvider creates a new ACME-based certificate provider
+func NewACMEProvider(cfg ACMEConfig, logger Logger) *ACMEProvider {
+	return &ACMEProvider{
+		cfg:    cfg,
+		logger: logger,
+	}
+}
+
+// GetCertificate returns the certificate for the handshake, obtaining it if
+// needed. Clients without SNI get the certificate of the configured domain.
+func (p *ACMEProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if p.manager == nil {
+		return nil, errors.New("ACME provider not started")
+	}
+	if hello.ServerName == "" {
+		withName := *hello
+		withName.ServerName = p.cfg.Domain
+		hello = &withName
+	}
+	return p.manager.GetCertificate(hello)
+}
+
+// Current returns the certificate of serverName in the cache, where the
+// manager keeps what it obtained. Unlike GetCertificate it never places an
+// order. Clients without SNI get the certificate of the configured domain.
+func (p *ACMEProvider) Current(serverName string) (*x509.Certificate, error) {
+	if p.manager == nil {
+		return nil, errors.New("ACME provider not started")
+	}
+	serverName = cmp.Or(normalizeServerName(serverName), p.cfg.Domain)
+	if !slices.Contains(p.domains(), serverName) {
+		return nil, fmt.Errorf("no certificate for server name: %q", serverName)
+	}
+	// Start asks for ECDSA certificates, cached under the bare name
+	data, err := p.manager.Cache.Get(context.Background(), serverName)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, fmt.Errorf("no ACME certificate for domain %s yet", serverName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The cache entry is the private key followed by the chain
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+	return nil, fmt.Errorf("no certificate in the cache entry of domain %s", serverName)
+}
+
+// Start sets up the ACME client, the HTTP-01 listener and requests the
+// initial certificate in the background. Renewal is handled by autocert.
+func (p *ACMEProvider) Start(ctx context.Context) error {
+	if p.cfg.Domain == "" {
+		return errors.New("ACME provider requires a domain")
+	}
+	if p.cfg.HTTPAddr == "" {
+		return errors.New("ACME provider requires an address for HTTP-01 challenges")
+	}
+
+	client := &acme.Client{DirectoryURL: p.cfg.DirectoryURL}
+	if p.cfg.CARootFile != "" {
+		httpClient, err := httpClientWithRoot(p.cfg.CARootFile)
+		if err != nil {
+			return err
+		}
+		client.HTTPClient = httpClient
+	}
+
+	p.manager = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(p.cfg.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(p.domains()...),
+		RenewBefore: p.cfg.RenewBefore,
+		Email:       p.cfg.Email,
+		Client:      client,
+	}
+
+	ln, err := net.Listen("tcp", p.cfg.HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for HTTP-01 challenges: %w", err)
+	}
+	p.httpSrv = &http.Server{
+		Handler:           p.manager.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := p.httpSrv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			p.logger.Errorf("HTTP-01 challenge server stopped: %v", err)
+		}
+	}()
+
+	// Obtain (or load from cache) the initial certificates, which also
+	// schedules their renewal
+	for _, domain := range p.domains() {
+		go func() {
+			_, err := p.GetCertificate(&tls.ClientHelloInfo{
+				ServerName:   domain,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			})
+			if err != nil {
+				p.logger.Errorf("Failed to get ACME certificate for domain %s: %v", domain, err)
+				return
+			}
+			p.logger.Infof("ACME certificate ready for domain: %s", domain)
+		}()
+	}
+
+	return nil
+}
+
+// domains returns all domains of the provider, the main one first
+func (p *ACMEProvider) domains() []string {
+	return append([]string{p.cfg.Domain}, p.cfg.ExtraDomains...)
+}
+
+// Stop shuts the HTTP-01 challenge listener down
+func (p *ACMEProvider) Stop() {
+	if p.httpSrv != nil {
+		p.httpSrv.Close()
+	}
+}
+
+// httpClientWithRoot returns an HTTP client that additionally trusts the PEM root at path
+func httpClientWithRoot(path string) (*http.Client, error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACME CA root: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
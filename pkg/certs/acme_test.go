@@ -0,0 +1,193 @@
+package certs
+
+import (
+	"cmp"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger logs through t
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Errorf(format string, args ...interface{}) { l.t.Logf("ERROR "+format, args...) }
+func (l testLogger) Infof(format string, args ...interface{})  { l.t.Logf(format, args...) }
+
+// nopLogger drops everything, for goroutines that may outlive a test
+type nopLogger struct{}
+
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+
+// testCert returns the PEM certificate and key of a self-signed certificate
+// for names, valid from notBefore to notAfter
+func testCert(t *testing.T, names []string, notBefore, notAfter time.Time) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// TestACMEProviderServerName serves certificates from the cache, so no CA is
+// needed: clients without SNI get the configured domain's, names outside
+// the configured domains are refused without an order.
+func TestACMEProviderServerName(t *testing.T) {
+	cacheDir := t.TempDir()
+	now := time.Now()
+	certPEM, keyPEM := testCert(t, []string{"bie.test"}, now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	// autocert caches the key followed by the chain, under the domain
+	if err := os.WriteFile(filepath.Join(cacheDir, "bie.test"), append(keyPEM, certPEM...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := NewACMEProvider(ACMEConfig{
+		Domain:   "bie.test",
+		CacheDir: cacheDir,
+		// Nothing listens there, any order fails
+		DirectoryURL: "https://127.0.0.1:1/dir",
+		HTTPAddr:     "127.0.0.1:0",
+		RenewBefore:  time.Hour,
+	}, nopLogger{})
+
+	hello := func(serverName string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:   serverName,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+	}
+	if _, err := provider.GetCertificate(hello("bie.test")); err == nil {
+		t.Error("GetCertificate before Start succeeded")
+	}
+
+	if err := provider.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer provider.Stop()
+
+	for _, tc := range []struct {
+		serverName string
+		// Empty if refused
+		want string
+	}{
+		{"bie.test", "bie.test"},
+		{"", "bie.test"},
+		{"01-token.bie.test", ""},
+		{"other.test", ""},
+	} {
+		cert, err := provider.GetCertificate(hello(tc.serverName))
+		if tc.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "HostWhitelist") {
+				t.Errorf("GetCertificate(%q) = %v, want refused by the host policy", tc.serverName, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("GetCertificate(%q): %v", tc.serverName, err)
+			continue
+		}
+		if !slices.Equal(cert.Leaf.DNSNames, []string{tc.want}) {
+			t.Errorf("GetCertificate(%q) served %v, want %s", tc.serverName, cert.Leaf.DNSNames, tc.want)
+		}
+	}
+}
+
+// TestACMEProviderPebble obtains a certificate from a Pebble CA. Run Pebble
+// with PEBBLE_VA_ALWAYS_VALID=1, or have the domain resolve to this host,
+// and point the test at it:
+//
+//	PEBBLE_DIRECTORY_URL=https://localhost:14000/dir \
+//	PEBBLE_CA_ROOT=pebble.minica.pem \
+//	go test ./pkg/certs -run Pebble
+//
+// PEBBLE_DOMAIN (bie.test) and PEBBLE_HTTP_ADDR (:5002, Pebble's HTTP-01
+// port) are optional.
+func TestACMEProviderPebble(t *testing.T) {
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directoryURL == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL not set")
+	}
+	domain := cmp.Or(os.Getenv("PEBBLE_DOMAIN"), "bie.test")
+
+	provider := NewACMEProvider(ACMEConfig{
+		Domain:       domain,
+		Email:        "admin@" + domain,
+		CacheDir:     t.TempDir(),
+		DirectoryURL: directoryURL,
+		CARootFile:   os.Getenv("PEBBLE_CA_ROOT"),
+		HTTPAddr:     cmp.Or(os.Getenv("PEBBLE_HTTP_ADDR"), ":5002"),
+		RenewBefore:  time.Hour,
+	}, testLogger{t})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := provider.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer provider.Stop()
+
+	// Blocks until the order Start placed is done
+	cert, err := provider.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:   domain,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	leaf := cert.Leaf
+	if !slices.Contains(leaf.DNSNames, domain) {
+		t.Errorf("certificate is for %v, want %s", leaf.DNSNames, domain)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		t.Errorf("certificate valid from %s to %s, not now", leaf.NotBefore, leaf.NotAfter)
+	}
+
+	// The health checks see it without placing another order
+	current, err := provider.Current(domain)
+	if err != nil {
+		t.Fatalf("Current: %v", err)
+	}
+	if !current.Equal(leaf) {
+		t.Error("Current returned another certificate than the one served")
+	}
+
+	// Clients without SNI get the certificate of the domain
+	cert, err = provider.GetCertificate(&tls.ClientHelloInfo{
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("GetCertificate without SNI: %v", err)
+	}
+	if !cert.Leaf.Equal(leaf) {
+		t.Error("clients without SNI got another certificate")
+	}
+}
@@ -2,6 +2,7 @@ package certs
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 )
 
@@ -21,10 +22,10 @@ func NewLoggerAdapter(logger *slog.Logger, ctx context.Context) *LoggerAdapter {
 
 // Errorf implements certs.Logger interface
 func (l *LoggerAdapter) Errorf(format string, args ...interface{}) {
-	l.logger.ErrorContext(l.ctx, format, args...)
+	l.logger.ErrorContext(l.ctx, fmt.Sprintf(format, args...))
 }
 
 // Infof implements certs.Logger interface
 func (l *LoggerAdapter) Infof(format string, args ...interface{}) {
-	l.logger.InfoContext(l.ctx, format, args...)
+	l.logger.InfoContext(l.ctx, fmt.Sprintf(format, args...))
 }
@@ -3,6 +3,7 @@ package certs
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"sync"
 	"time"
@@ -10,20 +11,38 @@ import (
 
 // Provider defines the interface for certificate providers
 type Provider interface {
-	GetCertificate() *tls.Certificate
+	// GetCertificate returns the certificate for the handshake, hello may be
+	// inspected for SNI or ALPN
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	// Current returns the certificate served for serverName right now,
+	// without obtaining or loading one, e.g. for health checks
+	Current(serverName string) (*x509.Certificate, error)
 	Start(ctx context.Context) error
 	Stop()
 }
 
-// FSProvider implements certificate loading from filesystem
+// TLSConfig returns a server TLS config serving certificates from the provider
+func TLSConfig(provider Provider) *tls.Config {
+	return &tls.Config{
+		GetCertificate: provider.GetCertificate,
+	}
+}
+
+// Reloader is implemented by providers that can reload their certificate on demand
+type Reloader interface {
+	Reload() error
+}
+
+// FSProvider implements certificate loading from filesystem. The files are
+// watched and reloaded when they change, including certbot's symlink swaps.
 type FSProvider struct {
-	domain     string
-	certPath   string
-	keyPath    string
-	reloadFreq time.Duration
+	domain   string
+	certPath string
+	keyPath  string
 
 	mu       sync.RWMutex
 	cert     tls.Certificate
+	notAfter time.Time
 	stopChan chan struct{}
 	logger   Logger
 }
@@ -37,69 +56,100 @@ type Logger interface {
 // NewFSProvider creates a new filesystem-based certificate provider
 func NewFSProvider(domain string, certPath, keyPath string, logger Logger) *FSProvider {
 	return &FSProvider{
-		domain:     domain,
-		certPath:   certPath,
-		keyPath:    keyPath,
-		reloadFreq: 24 * time.Hour,
-		stopChan:   make(chan struct{}),
-		logger:     logger,
+		domain:   domain,
+		certPath: certPath,
+		keyPath:  keyPath,
+		stopChan: make(chan struct{}),
+		logger:   logger,
 	}
 }
 
-// loadCertificates loads certificates from filesystem
-func (p *FSProvider) loadCertificates() error {
+// loadCertificates loads certificates from filesystem and swaps them in
+// only if the pair matches and is currently valid. It reports whether the
+// certificate changed.
+func (p *FSProvider) loadCertificates() (bool, error) {
 	cert, err := tls.LoadX509KeyPair(p.certPath, p.keyPath)
 	if err != nil {
-		return fmt.Errorf("failed to load certificates: %w", err)
+		return false, fmt.Errorf("failed to load certificates: %w", err)
 	}
 
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return false, fmt.Errorf("certificate is not valid before %s", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return false, fmt.Errorf("certificate expired at %s", leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+
 	p.mu.Lock()
+	changed := p.cert.Leaf == nil || !p.cert.Leaf.Equal(leaf)
 	p.cert = cert
+	p.notAfter = leaf.NotAfter
 	p.mu.Unlock()
 
-	return nil
+	return changed, nil
 }
 
 // GetCertificate returns the current certificate
-func (p *FSProvider) GetCertificate() *tls.Certificate {
+func (p *FSProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return &p.cert
+	if p.cert.Leaf == nil {
+		return nil, fmt.Errorf("no certificate loaded for domain: %s", p.domain)
+	}
+	return &p.cert, nil
 }
 
-// Start begins the certificate reload loop
+// Current returns the loaded certificate, it is served for every name
+func (p *FSProvider) Current(serverName string) (*x509.Certificate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.cert.Leaf == nil {
+		return nil, fmt.Errorf("no certificate loaded for domain: %s", p.domain)
+	}
+	return p.cert.Leaf, nil
+}
+
+// NotAfter returns the expiry of the currently loaded certificate
+func (p *FSProvider) NotAfter() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.notAfter
+}
+
+// Reload loads the certificates again, keeping the current ones on failure
+func (p *FSProvider) Reload() error {
+	changed, err := p.loadCertificates()
+	if err != nil {
+		p.logger.Errorf("Failed to reload certificates: %v", err)
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	p.logger.Infof("Certificates successfully reloaded for domain: %s, valid until %s", p.domain, p.NotAfter())
+	return nil
+}
+
+// Start loads the certificates and begins watching the files for changes
 func (p *FSProvider) Start(ctx context.Context) error {
 	// Initial load
-	if err := p.loadCertificates(); err != nil {
+	if _, err := p.loadCertificates(); err != nil {
 		return err
 	}
-	p.logger.Infof("Initial certificates loaded for domain: %s", p.domain)
-
-	// Start reload loop
-	go func() {
-		ticker := time.NewTicker(p.reloadFreq)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-p.stopChan:
-				return
-			case <-ticker.C:
-				if err := p.loadCertificates(); err != nil {
-					p.logger.Errorf("Failed to reload certificates: %v", err)
-					continue
-				}
-				p.logger.Infof("Certificates successfully reloaded for domain: %s", p.domain)
-			}
-		}
-	}()
+	p.logger.Infof("Initial certificates loaded for domain: %s, valid until %s", p.domain, p.NotAfter())
 
-	return nil
+	return watchFiles(ctx, p.stopChan, []string{p.certPath, p.keyPath}, func() {
+		p.Reload()
+	})
 }
 
-// Stop halts the certificate reload loop
+// Stop halts watching the certificate files
 func (p *FSProvider) Stop() {
 	close(p.stopChan)
 }
@@ -0,0 +1,92 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writePair writes a certificate and key to dir as certbot names them
+func writePair(t *testing.T, dir string, certPEM, keyPEM []byte) (certPath, keyPath string) {
+	t.Helper()
+	certPath, keyPath = filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// TestFSProviderReload swaps in new pairs only if the key matches the
+// certificate and the certificate is valid now, keeping the current one
+// otherwise
+func TestFSProviderReload(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	valid := func(name string) ([]byte, []byte) {
+		return testCert(t, []string{name}, now.Add(-time.Hour), now.Add(time.Hour))
+	}
+
+	firstCert, firstKey := valid("first.bie.test")
+	certPath, keyPath := writePair(t, dir, firstCert, firstKey)
+	provider := NewFSProvider("bie.test", certPath, keyPath, testLogger{t})
+	if err := provider.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer provider.Stop()
+
+	served := func() string {
+		t.Helper()
+		leaf, err := provider.Current("bie.test")
+		if err != nil {
+			t.Fatalf("Current: %v", err)
+		}
+		return leaf.DNSNames[0]
+	}
+	if name := served(); name != "first.bie.test" {
+		t.Fatalf("serving %s after start, want first.bie.test", name)
+	}
+
+	_, otherKey := valid("other.bie.test")
+	renewedCert, renewedKey := valid("renewed.bie.test")
+	expiredCert, expiredKey := testCert(t, []string{"expired.bie.test"}, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	futureCert, futureKey := testCert(t, []string{"future.bie.test"}, now.Add(time.Hour), now.Add(2*time.Hour))
+	for _, tc := range []struct {
+		name       string
+		certPEM    []byte
+		keyPEM     []byte
+		wantErr    bool
+		wantServed string
+	}{
+		{"renewed", renewedCert, renewedKey, false, "renewed.bie.test"},
+		{"key of another certificate", renewedCert, otherKey, true, "renewed.bie.test"},
+		{"expired", expiredCert, expiredKey, true, "renewed.bie.test"},
+		{"not yet valid", futureCert, futureKey, true, "renewed.bie.test"},
+		{"not PEM", []byte("garbage"), renewedKey, true, "renewed.bie.test"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			writePair(t, dir, tc.certPEM, tc.keyPEM)
+			if err := provider.Reload(); (err != nil) != tc.wantErr {
+				t.Errorf("Reload: %v, want error: %v", err, tc.wantErr)
+			}
+			if name := served(); name != tc.wantServed {
+				t.Errorf("serving %s, want %s", name, tc.wantServed)
+			}
+		})
+	}
+
+	// Handshakes get what Current reports
+	cert, err := provider.GetCertificate(&tls.ClientHelloInfo{ServerName: "bie.test"})
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if !slices.Equal(cert.Leaf.DNSNames, []string{"renewed.bie.test"}) || !provider.NotAfter().Equal(cert.Leaf.NotAfter) {
+		t.Errorf("handshakes get %v until %s, want renewed.bie.test", cert.Leaf.DNSNames, provider.NotAfter())
+	}
+}
@@ -0,0 +1,120 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// SNIProvider picks a provider by the SNI server name, so one relay can serve
+// several domains. Patterns are exact names or "*.domain" wildcards matching
+// a single label; the fallback serves everything else.
+type SNIProvider struct {
+	fallback  Provider
+	exact     map[string]Provider
+	wildcard  map[string]Provider
+	providers []Provider
+}
+
+// NewSNIProvider creates a new SNI-routing provider, fallback may be nil
+func NewSNIProvider(fallback Provider) *SNIProvider {
+	p := &SNIProvider{
+		fallback: fallback,
+		exact:    make(map[string]Provider),
+		wildcard: make(map[string]Provider),
+	}
+	if fallback != nil {
+		p.providers = append(p.providers, fallback)
+	}
+	return p
+}
+
+// Add routes server names matching pattern to provider
+func (p *SNIProvider) Add(pattern string, provider Provider) {
+	pattern = normalizeServerName(pattern)
+	if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+		p.wildcard[domain] = provider
+	} else {
+		p.exact[pattern] = provider
+	}
+
+	for _, known := range p.providers {
+		if known == provider {
+			return
+		}
+	}
+	p.providers = append(p.providers, provider)
+}
+
+// GetCertificate returns the certificate of the provider matching the SNI
+func (p *SNIProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	provider := p.match(hello.ServerName)
+	if provider == nil {
+		return nil, fmt.Errorf("no certificate for server name: %q", hello.ServerName)
+	}
+	return provider.GetCertificate(hello)
+}
+
+// Current returns the current certificate of the provider matching serverName
+func (p *SNIProvider) Current(serverName string) (*x509.Certificate, error) {
+	provider := p.match(serverName)
+	if provider == nil {
+		return nil, fmt.Errorf("no certificate for server name: %q", serverName)
+	}
+	return provider.Current(serverName)
+}
+
+// Start starts every provider
+func (p *SNIProvider) Start(ctx context.Context) error {
+	for i, provider := range p.providers {
+		if err := provider.Start(ctx); err != nil {
+			for _, started := range p.providers[:i] {
+				started.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops every provider
+func (p *SNIProvider) Stop() {
+	for _, provider := range p.providers {
+		provider.Stop()
+	}
+}
+
+// Reload reloads every provider that supports it
+func (p *SNIProvider) Reload() error {
+	var firstErr error
+	for _, provider := range p.providers {
+		if reloader, ok := provider.(Reloader); ok {
+			if err := reloader.Reload(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (p *SNIProvider) match(serverName string) Provider {
+	serverName = normalizeServerName(serverName)
+	if serverName == "" {
+		return p.fallback
+	}
+	if provider, ok := p.exact[serverName]; ok {
+		return provider
+	}
+	if _, domain, ok := strings.Cut(serverName, "."); ok {
+		if provider, ok := p.wildcard[domain]; ok {
+			return provider
+		}
+	}
+	return p.fallback
+}
+
+func normalizeServerName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,87 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+// stubProvider serves a certificate carrying its name
+type stubProvider struct{ name string }
+
+func (p *stubProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &tls.Certificate{Leaf: &x509.Certificate{DNSNames: []string{p.name}}}, nil
+}
+
+func (p *stubProvider) Current(serverName string) (*x509.Certificate, error) {
+	return &x509.Certificate{DNSNames: []string{p.name}}, nil
+}
+
+func (p *stubProvider) Start(ctx context.Context) error { return nil }
+func (p *stubProvider) Stop()                           {}
+
+// TestSNIProviderMatch routes by exact names and "*.domain" wildcards of a
+// single label, everything else goes to the fallback
+func TestSNIProviderMatch(t *testing.T) {
+	for _, fallback := range []*stubProvider{{name: "fallback"}, nil} {
+		sni := NewSNIProvider(nil)
+		if fallback != nil {
+			sni = NewSNIProvider(fallback)
+		}
+		sni.Add("bie.test", &stubProvider{name: "apex"})
+		sni.Add("*.bie.test", &stubProvider{name: "wildcard"})
+		vanity := &stubProvider{name: "vanity"}
+		sni.Add("Vanity.Example", vanity)
+		sni.Add("*.vanity.example", vanity)
+
+		for _, tc := range []struct {
+			serverName string
+			provider   string
+		}{
+			{"bie.test", "apex"},
+			{"BIE.Test", "apex"},
+			{"bie.test.", "apex"},
+			{"01-token.bie.test", "wildcard"},
+			{"01-Token.BIE.TEST", "wildcard"},
+			{"deep.01-token.bie.test", "fallback"},
+			{"xbie.test", "fallback"},
+			{"test", "fallback"},
+			{"", "fallback"},
+			{"vanity.example", "vanity"},
+			{"01-token.vanity.example", "vanity"},
+			{"other.example", "fallback"},
+		} {
+			name := tc.serverName + " with fallback"
+			if fallback == nil {
+				name = tc.serverName + " without fallback"
+			}
+			t.Run(name, func(t *testing.T) {
+				wantProvider := tc.provider
+				if fallback == nil && wantProvider == "fallback" {
+					// Refused without a fallback
+					wantProvider = ""
+				}
+				cert, err := sni.GetCertificate(&tls.ClientHelloInfo{ServerName: tc.serverName})
+				if wantProvider == "" {
+					if err == nil {
+						t.Errorf("served %v, want no certificate", cert.Leaf.DNSNames)
+					}
+					if _, err := sni.Current(tc.serverName); err == nil {
+						t.Error("Current found a certificate, want none")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("GetCertificate: %v", err)
+				}
+				if got := cert.Leaf.DNSNames[0]; got != wantProvider {
+					t.Errorf("served by %s, want %s", got, wantProvider)
+				}
+				if leaf, err := sni.Current(tc.serverName); err != nil || leaf.DNSNames[0] != wantProvider {
+					t.Errorf("Current from %v (%v), want %s", leaf, err, wantProvider)
+				}
+			})
+		}
+	}
+}
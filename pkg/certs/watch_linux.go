@@ -0,0 +1,133 @@
+package certs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	watchMask = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+		unix.IN_CLOSE_WRITE | unix.IN_DELETE | unix.IN_ATTRIB
+	// Certbot writes the certificate and the key one after the other
+	debounceDelay = time.Second
+)
+
+// watchFiles calls onChange, debounced, whenever one of paths may have changed.
+// The directories of the paths and of their symlink targets are watched,
+// since certbot and Kubernetes replace files by swapping symlinks.
+func watchFiles(ctx context.Context, stop <-chan struct{}, paths []string, onChange func()) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("failed to init inotify: %w", err)
+	}
+	// Non-blocking fd, so reads go through the runtime poller and Close unblocks them
+	inotify := os.NewFile(uintptr(fd), "inotify")
+
+	watches := &dirWatches{fd: fd, wds: make(map[string]int)}
+	if err := watches.update(watchDirs(paths)); err != nil {
+		inotify.Close()
+		return err
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			if _, err := inotify.Read(buf); err != nil {
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	go func() {
+		defer inotify.Close()
+
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			case _, ok := <-events:
+				if !ok {
+					return
+				}
+				debounce = time.After(debounceDelay)
+			case <-debounce:
+				debounce = nil
+				onChange()
+				// Symlinks may point to a new directory now
+				watches.update(watchDirs(paths))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// dirWatches tracks the directories an inotify instance watches
+type dirWatches struct {
+	fd int
+	// Watch descriptor by directory
+	wds map[string]int
+}
+
+// update watches dirs and stops watching the directories not among them, so
+// watches do not pile up as symlinks move to new targets
+func (w *dirWatches) update(dirs []string) error {
+	var errs []error
+	for _, dir := range dirs {
+		wd, err := unix.InotifyAddWatch(w.fd, dir, watchMask)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to watch %s: %w", dir, err))
+			continue
+		}
+		w.wds[dir] = wd
+	}
+	for dir, wd := range w.wds {
+		if slices.Contains(dirs, dir) {
+			continue
+		}
+		delete(w.wds, dir)
+		// Another path may lead to the same directory, and so the same
+		// descriptor. Removed directories lost their watch already.
+		if !slices.Contains(slices.Collect(maps.Values(w.wds)), wd) {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// watchDirs returns the directories holding paths and their symlink targets
+func watchDirs(paths []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, path := range paths {
+		add(filepath.Dir(path))
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			add(filepath.Dir(resolved))
+		}
+	}
+	return dirs
+}
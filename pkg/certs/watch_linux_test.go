@@ -0,0 +1,127 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestFSProviderSymlinkSwap reloads the certificate once the symlinks it is
+// read through point to a new directory, as Kubernetes swaps secrets
+func TestFSProviderSymlinkSwap(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	for i, name := range []string{"first.bie.test", "second.bie.test"} {
+		dir := filepath.Join(root, fmt.Sprintf("data%d", i+1))
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		certPEM, keyPEM := testCert(t, []string{name}, now.Add(-time.Hour), now.Add(time.Hour))
+		writePair(t, dir, certPEM, keyPEM)
+	}
+	link := func(target string) {
+		t.Helper()
+		// Replaced atomically, like ..data
+		tmp := filepath.Join(root, "..data_tmp")
+		if err := os.Symlink(target, tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(root, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link("data1")
+	for _, name := range []string{"fullchain.pem", "privkey.pem"} {
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The watcher may reload after the test is over
+	provider := NewFSProvider("bie.test", filepath.Join(root, "fullchain.pem"), filepath.Join(root, "privkey.pem"), nopLogger{})
+	if err := provider.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer provider.Stop()
+
+	link("data2")
+	deadline := time.Now().Add(5 * debounceDelay)
+	for {
+		leaf, err := provider.Current("bie.test")
+		if err != nil {
+			t.Fatalf("Current: %v", err)
+		}
+		if leaf.DNSNames[0] == "second.bie.test" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still serving %s after the symlink swap", leaf.DNSNames[0])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestDirWatchesUpdate stops watching directories symlinks no longer point
+// into
+func TestDirWatchesUpdate(t *testing.T) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+
+	root := t.TempDir()
+	var dirs []string
+	for i := range 4 {
+		dir := filepath.Join(root, fmt.Sprintf("archive%d", i))
+		if err := os.Mkdir(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	w := &dirWatches{fd: fd, wds: make(map[string]int)}
+	// The live directory stays, the target moves on every renewal
+	for i := 1; i < len(dirs); i++ {
+		if err := w.update([]string{dirs[0], dirs[i]}); err != nil {
+			t.Fatal(err)
+		}
+		if len(w.wds) != 2 {
+			t.Errorf("tracking %d directories after renewal %d, want 2", len(w.wds), i)
+		}
+		if n := kernelWatches(t, fd); n != 2 {
+			t.Errorf("%d inotify watches after renewal %d, want 2", n, i)
+		}
+	}
+
+	// A directory reached by two paths keeps its watch while one is left
+	alias := filepath.Join(root, "alias")
+	if err := os.Symlink(dirs[0], alias); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.update([]string{dirs[0], alias}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.update([]string{alias}); err != nil {
+		t.Fatal(err)
+	}
+	if n := kernelWatches(t, fd); n != 1 {
+		t.Errorf("%d inotify watches on the aliased directory, want 1", n)
+	}
+}
+
+// kernelWatches counts the watches of inotify instance fd
+func kernelWatches(t *testing.T, fd int) int {
+	t.Helper()
+	info, err := os.ReadFile(fmt.Sprintf("/proc/self/fdinfo/%d", fd))
+	if err != nil {
+		t.Skipf("cannot count inotify watches: %v", err)
+	}
+	return strings.Count(string(info), "inotify wd:")
+}
@@ -0,0 +1,51 @@
+//go:build !linux
+
+package certs
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+const pollInterval = time.Minute
+
+// watchFiles polls the modification times of paths, as there is no inotify,
+// and calls onChange when one of them changed
+func watchFiles(ctx context.Context, stop <-chan struct{}, paths []string, onChange func()) error {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		last := modTimes(paths)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+				current := modTimes(paths)
+				for i := range current {
+					if !current[i].Equal(last[i]) {
+						onChange()
+						break
+					}
+				}
+				last = current
+			}
+		}
+	}()
+
+	return nil
+}
+
+func modTimes(paths []string) []time.Time {
+	times := make([]time.Time, len(paths))
+	for i, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
@@ -0,0 +1,530 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"bie/pkg/biecy"
+	"bie/pkg/bietrace"
+	"bie/pkg/biewire"
+	"bie/pkg/osserver"
+)
+
+// Chunked uploads split a file into ranges sent over many connections, each
+// a sender of its own on the relay:
+//
+//	POST   /file/chunked          JSON chunkedManifest, before any chunk
+//	PUT    /file/chunks/{index}   chunk data, Bie-Chunk-Sha256 header
+//	DELETE /file/chunked          the sender gave up
+//
+// The receiver writes chunks in place with WriteAt and is done once every
+// chunk arrived with a matching hash. With a stream key each chunk is an
+// encrypted stream of its own, starting with the chunk's offset, so chunks
+// cannot be swapped. Chunks that compress are sent with a Content-Encoding,
+// the hash is of the plain data.
+const (
+	chunkSize     = 4 << 20
+	chunkAttempts = 3
+	chunkHeader   = "Bie-Chunk-Sha256"
+	// Larger files go as a plain upload, this bounds the chunks a receiver tracks
+	maxChunkedSize = 1 << 40
+	// How long the receiver waits for a sender with no connection open
+	chunkIdleTimeout = time.Minute
+)
+
+var errSenderGone = errors.New("sender left before the transfer completed")
+
+type chunkedManifest struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+func (m chunkedManifest) chunks() int64 {
+	return (m.Size + m.ChunkSize - 1) / m.ChunkSize
+}
+
+// chunk returns the offset and length of chunk index
+func (m chunkedManifest) chunk(index int64) (int64, int64) {
+	offset := index * m.ChunkSize
+	return offset, min(m.ChunkSize, m.Size-offset)
+}
+
+// receiveChunked serves senders over every stream of the registration until
+// a chunked or plain upload completed
+func (r *Receiver) receiveChunked(ctx context.Context, open func() (io.Writer, error)) (biewire.TransferReport, error) {
+	listener := osserver.NewConnListener(r.current().LocalAddr())
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := r.acceptConn()
+			if err != nil {
+				return
+			}
+			if err := listener.Push(conn); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	u := &chunkedUpload{
+		receiver: r,
+		// Chunked and plain uploads may both try to open the destination
+		open:     sync.OnceValues(open),
+		finished: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", u.handlePlain)
+	mux.HandleFunc("POST /file/chunked", u.handleManifest)
+	mux.HandleFunc("DELETE /file/chunked", u.handleAbort)
+	mux.HandleFunc("PUT /file/chunks/{index}", u.handleChunk)
+
+	srv := &http.Server{Handler: traceHandler(ctx, mux), ConnState: u.trackConn}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(listener) }()
+
+	var err error
+	select {
+	case <-u.finished:
+	case <-ctx.Done():
+		srv.Close()
+		err = ctx.Err()
+	case err = <-serveErr:
+		err = fmt.Errorf("server error: %w", err)
+	}
+	if err != nil {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		return u.report, err
+	}
+
+	// Let the last responses reach the sender
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.report, u.err
+}
+
+// chunkedUpload is the receiver's state of an upload in flight
+type chunkedUpload struct {
+	receiver *Receiver
+	open     func() (io.Writer, error)
+
+	mu       sync.Mutex
+	manifest *chunkedManifest
+	dst      io.WriterAt
+	received []bool
+	missing  int64
+	report   biewire.TransferReport
+	// Open sender connections, the upload fails once none was open for
+	// chunkIdleTimeout
+	conns    int
+	idle     *time.Timer
+	err      error
+	finished chan struct{}
+	once     sync.Once
+}
+
+// finish ends the upload with err, the first call wins. u.mu must be held.
+func (u *chunkedUpload) finish(err error) {
+	u.once.Do(func() {
+		u.err = err
+		close(u.finished)
+	})
+}
+
+func (u *chunkedUpload) trackConn(_ net.Conn, state http.ConnState) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		u.conns++
+		if u.idle != nil {
+			u.idle.Stop()
+		}
+	case http.StateClosed, http.StateHijacked:
+		u.conns--
+		if u.conns == 0 && u.manifest != nil && u.missing > 0 {
+			// Senders reconnect between retries, give them a while
+			u.idle = time.AfterFunc(chunkIdleTimeout, u.senderIdle)
+		}
+	}
+}
+
+// senderIdle fails the upload if the sender still has no connection open
+func (u *chunkedUpload) senderIdle() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conns == 0 && u.missing > 0 {
+		u.finish(errSenderGone)
+	}
+}
+
+// handlePlain takes a whole file in one request, as curl sends it
+func (u *chunkedUpload) handlePlain(w http.ResponseWriter, req *http.Request) {
+	u.mu.Lock()
+	started := u.manifest != nil
+	u.mu.Unlock()
+	if started {
+		http.Error(w, "A chunked upload is in progress", http.StatusConflict)
+		return
+	}
+
+	report, err := u.receiver.handleUpload(w, req, u.open)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.report = report
+	u.finish(err)
+}
+
+func (u *chunkedUpload) handleManifest(w http.ResponseWriter, req *http.Request) {
+	var manifest chunkedManifest
+	if err := json.NewDecoder(io.LimitReader(req.Body, 4096)).Decode(&manifest); err != nil ||
+		manifest.Size <= 0 || manifest.Size > maxChunkedSize || manifest.ChunkSize != chunkSize {
+		http.Error(w, "Invalid manifest", http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.manifest != nil {
+		http.Error(w, "Upload already started", http.StatusConflict)
+		return
+	}
+
+	out, err := u.open()
+	if err != nil {
+		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		u.finish(err)
+		return
+	}
+	dst, ok := out.(io.WriterAt)
+	if !ok {
+		// The sender falls back to a plain upload
+		http.Error(w, "Receiver cannot write chunks in place", http.StatusNotImplemented)
+		return
+	}
+	if f, ok := out.(interface{ Truncate(int64) error }); ok {
+		if err := f.Truncate(manifest.Size); err != nil {
+			http.Error(w, "Failed to allocate file", http.StatusInternalServerError)
+			u.finish(err)
+			return
+		}
+	}
+
+	u.manifest = &manifest
+	u.dst = dst
+	u.received = make([]bool, manifest.chunks())
+	u.missing = manifest.chunks()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (u *chunkedUpload) handleAbort(w http.ResponseWriter, req *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+	u.finish(errors.New("sender aborted the transfer"))
+}
+
+func (u *chunkedUpload) handleChunk(w http.ResponseWriter, req *http.Request) {
+	u.mu.Lock()
+	manifest, dst := u.manifest, u.dst
+	u.mu.Unlock()
+	if manifest == nil {
+		http.Error(w, "Upload not started", http.StatusConflict)
+		return
+	}
+	index, err := strconv.ParseInt(req.PathValue("index"), 10, 64)
+	if err != nil || index < 0 || index >= manifest.chunks() {
+		http.Error(w, "Invalid chunk", http.StatusBadRequest)
+		return
+	}
+	want, err := hex.DecodeString(req.Header.Get(chunkHeader))
+	if err != nil || len(want) != sha256.Size {
+		http.Error(w, "Missing chunk hash", http.StatusBadRequest)
+		return
+	}
+	offset, length := manifest.chunk(index)
+
+	src, err := u.receiver.chunkReader(req.Body, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wire := &countingReader{r: src}
+	encoding := req.Header.Get("Content-Encoding")
+	decoded, err := decompressReader(wire, encoding)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	defer decoded.Close()
+	src = decoded
+	hash := sha256.New()
+	n, err := io.Copy(io.NewOffsetWriter(dst, offset), io.TeeReader(io.LimitReader(src, length), hash))
+	if err == nil && n == length {
+		// Anything after the chunk is a bad sender, or a cut encrypted stream
+		var extra [1]byte
+		if m, readErr := io.ReadFull(src, extra[:]); m > 0 {
+			err = errors.New("chunk is too long")
+		} else if readErr != io.EOF {
+			err = readErr
+		}
+	}
+	if err == nil && n != length {
+		err = fmt.Errorf("chunk is %d bytes, expected %d", n, length)
+	}
+	if err == nil && !bytes.Equal(hash.Sum(nil), want) {
+		err = errors.New("chunk hash mismatch")
+	}
+	if err != nil {
+		// The sender retries, overwriting what was written
+		http.Error(w, fmt.Sprintf("Failed to receive chunk: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.received[index] {
+		u.received[index] = true
+		u.missing--
+		u.report.LogicalBytes += length
+		u.report.Bytes += wire.n
+		if encoding != "" {
+			u.report.Encoding = encoding
+		}
+		if report := u.receiver.opts.Progress; report != nil {
+			report(Progress{Transferred: u.report.LogicalBytes, Total: manifest.Size})
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if u.missing == 0 {
+		u.finish(nil)
+	}
+}
+
+// chunkReader returns the plain data of a chunk body at offset
+func (r *Receiver) chunkReader(body io.Reader, offset int64) (io.Reader, error) {
+	if r.Key == nil {
+		return body, nil
+	}
+	src, err := biecy.DecryptReader(body, r.Key)
+	if err != nil {
+		return nil, errors.New("chunk is not encrypted")
+	}
+	var prefix [8]byte
+	if _, err := io.ReadFull(src, prefix[:]); err != nil || int64(binary.BigEndian.Uint64(prefix[:])) != offset {
+		return nil, errors.New("chunk belongs to another offset")
+	}
+	return src, nil
+}
+
+// uploadChunked sends size bytes of r in chunks over up to n connections of
+// client, retrying failed chunks. errChunkedRefused means the receiver wants
+// a plain upload instead.
+func uploadChunked(ctx context.Context, client *http.Client, target string, r io.ReaderAt, streamKey []byte, encodings []string, opts Options, n int) error {
+	manifest := chunkedManifest{Name: opts.Name, Size: opts.Size, ChunkSize: chunkSize}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := chunkRequest(ctx, client, http.MethodPost, target+"/chunked", nil, body); err != nil {
+		var status *statusError
+		if errors.As(err, &status) && (status.code == http.StatusNotFound || status.code == http.StatusNotImplemented) {
+			return errChunkedRefused
+		}
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	indices := make(chan int64)
+	go func() {
+		defer close(indices)
+		for index := range manifest.chunks() {
+			select {
+			case indices <- index:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	encoder := chunkEncoder{mode: opts.Compression, accepted: encodings}
+	var mu sync.Mutex
+	progress := Progress{Total: manifest.Size}
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, chunkSize)
+			for index := range indices {
+				offset, length := manifest.chunk(index)
+				if err := sendChunk(ctx, client, target, r, streamKey, encoder, index, offset, buf[:length]); err != nil {
+					cancel(fmt.Errorf("chunk %d: %w", index, err))
+					return
+				}
+				if opts.Progress != nil {
+					mu.Lock()
+					progress.Transferred += length
+					opts.Progress(progress)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil {
+		// Let the receiver stop waiting, on a fresh context as ours is done
+		abortCtx, cancelAbort := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelAbort()
+		chunkRequest(abortCtx, client, http.MethodDelete, target+"/chunked", nil, nil)
+		return err
+	}
+	return nil
+}
+
+// chunkEncoder picks the encoding of each chunk on its own, so the
+// compressible parts of a file are compressed even if others are not
+type chunkEncoder struct {
+	mode     string
+	accepted []string
+}
+
+// encode returns data compressed and its encoding, or data as is when it
+// does not get smaller
+func (e chunkEncoder) encode(data []byte) ([]byte, string, error) {
+	encoding := pickEncoding(e.mode, e.accepted, data[:min(len(data), compressSample)])
+	if encoding == "" {
+		return data, "", nil
+	}
+	var compressed bytes.Buffer
+	comp, err := compressWriter(&compressed, encoding)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = comp.Write(data)
+	if closeErr := comp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if compressed.Len() >= len(data) {
+		return data, "", nil
+	}
+	return compressed.Bytes(), encoding, nil
+}
+
+// sendChunk uploads the chunk at offset, read into buf, retrying a few times
+func sendChunk(ctx context.Context, client *http.Client, target string, r io.ReaderAt, streamKey []byte, encoder chunkEncoder, index, offset int64, buf []byte) error {
+	if _, err := r.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return err
+	}
+	sum := sha256.Sum256(buf)
+	header := http.Header{chunkHeader: []string{hex.EncodeToString(sum[:])}}
+
+	body, encoding, err := encoder.encode(buf)
+	if err != nil {
+		return err
+	}
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+	if streamKey != nil {
+		var encrypted bytes.Buffer
+		enc, err := biecy.EncryptWriter(&encrypted, streamKey)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(enc, binary.BigEndian, uint64(offset)); err != nil {
+			return err
+		}
+		if _, err := enc.Write(body); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		body = encrypted.Bytes()
+	}
+
+	target = fmt.Sprintf("%s/chunks/%d", target, index)
+	for range chunkAttempts {
+		if err = chunkRequest(ctx, client, http.MethodPut, target, header, body); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func chunkRequest(ctx context.Context, client *http.Client, method, target string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	bietrace.InjectHeader(ctx, req.Header)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &statusError{code: resp.StatusCode, msg: fmt.Sprintf("upload rejected: %s: %s", resp.Status, msg)}
+	}
+	// Drain it so the connection is reused
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// parallelClient returns a client like client that keeps up to n HTTP/1.1
+// connections open, one per chunk in flight
+func parallelClient(client *http.Client, n int) *http.Client {
+	base, ok := client.Transport.(*http.Transport)
+	if !ok {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	transport := base.Clone()
+	transport.MaxConnsPerHost = n
+	transport.MaxIdleConnsPerHost = n
+	// HTTP/2 would put every chunk on one connection
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	return &http.Client{Transport: transport}
+}
+
+var errChunkedRefused = errors.New("receiver does not take chunked uploads")
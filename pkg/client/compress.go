@@ -0,0 +1,127 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression modes of Options.Compression. Senders only compress with an
+// encoding the receiver advertises in its URL fragment, older receivers
+// would store the compressed bytes.
+const (
+	// Pick the receiver's preferred encoding, but skip content that looks
+	// compressed already
+	CompressAuto = "auto"
+	CompressZstd = "zstd"
+	CompressGzip = "gzip"
+	CompressOff  = "off"
+)
+
+// Encodings receivers decompress, in order of preference. The encoding is
+// named in the Content-Encoding header of the upload's file part or chunk
+// and applies to the plain data, under the encryption.
+var supportedEncodings = []string{CompressZstd, CompressGzip}
+
+// Bytes sampled to tell whether content compresses
+const compressSample = 128 << 10
+
+// Below this compress.Estimate expects compressing to gain little, like for
+// archives, media and encrypted data
+const minCompressibility = 0.1
+
+// acceptedEncodings returns what a receiver in mode advertises
+func acceptedEncodings(mode string) []string {
+	if mode == CompressOff {
+		return nil
+	}
+	return supportedEncodings
+}
+
+// pickEncoding returns the encoding a sender in mode uses for a receiver
+// advertising accepted, empty for none. sample decides for CompressAuto.
+func pickEncoding(mode string, accepted []string, sample []byte) string {
+	switch mode {
+	case CompressOff:
+		return ""
+	case CompressZstd, CompressGzip:
+		if slices.Contains(accepted, mode) {
+			return mode
+		}
+		return ""
+	}
+	if compress.Estimate(sample) < minCompressibility {
+		return ""
+	}
+	for _, encoding := range supportedEncodings {
+		if slices.Contains(accepted, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// parseEncodings reads the encodings a receiver advertises in its URL
+// fragment
+func parseEncodings(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// peekSample returns r buffered and its first bytes, to pick an encoding
+// without consuming them
+func peekSample(r io.Reader) (io.Reader, []byte) {
+	buffered := bufio.NewReaderSize(r, compressSample)
+	sample, _ := buffered.Peek(compressSample)
+	return buffered, sample
+}
+
+// compressWriter compresses what is written to it into dst with encoding,
+// Close flushes it without closing dst
+func compressWriter(dst io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case CompressZstd:
+		return zstd.NewWriter(dst)
+	case CompressGzip:
+		return gzip.NewWriter(dst), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// decompressReader decompresses src with encoding, empty for none. Close
+// releases the decoder.
+func decompressReader(src io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "", "identity":
+		return io.NopCloser(src), nil
+	case CompressZstd:
+		decoder, err := zstd.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CompressGzip:
+		return gzip.NewReader(src)
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
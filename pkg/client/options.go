@@ -0,0 +1,120 @@
+package client
+
+import (
+	"crypto/tls"
+	"time"
+
+	"bie/pkg/transport"
+)
+
+// Options configures how to reach the relay and what a transfer looks like.
+// Zero fields fall back to DefaultOptions.
+type Options struct {
+	// Relay address receivers connect to, host:port
+	ServerAddress string
+	// Relay domain, tokens are its subdomains
+	Domain string
+	// Relay port senders connect to
+	Port int
+	// TLS config for the connection to the relay, system roots when nil
+	TLSConfig   *tls.Config
+	DialTimeout time.Duration
+	// How to reach the relay: transport.TLS (default), transport.WebSocket,
+	// transport.QUIC or transport.Auto, which tries QUIC first. TLS and
+	// WebSocket go through HTTPS_PROXY if it is set.
+	Transport string
+	// smux tuning of the TLS and WebSocket transports, negotiated with the
+	// relay. Zero keeps smux's defaults and works with older relays.
+	Smux transport.SmuxParams
+	// Identifies the receiver to relays that keep an audit log, which only
+	// records its hash
+	AuthToken string
+	// How long to try to resume the registration after the connection to the
+	// relay dropped, negative disables reconnecting
+	ReconnectTimeout time.Duration
+
+	// Validity of the one-shot certificate senders trust by pin
+	CertLifetime time.Duration
+	// Receive with a short transfer code instead of a URL
+	Code bool
+	// Encrypt end to end with a key carried in the URL fragment
+	Encrypt bool
+	// Let the relay terminate TLS with its own certificate, so senders need
+	// no pin. The relay sees the traffic unless it is also encrypted.
+	RelayTLS bool
+	// Limits of senders of tunnels and file serving, lowered to the relay's
+	// own. 0 leaves them to the relay.
+	MaxConcurrent int
+	MaxTotal      int
+	// Connections to transfer a file over in chunks. Receivers accept up to
+	// this many and advertise it in the URL fragment, senders use at most as
+	// many as advertised, 1 disables it.
+	Parallel int
+	// CompressAuto (default), CompressZstd, CompressGzip or CompressOff.
+	// Receivers advertise the encodings they decompress unless it is off,
+	// senders compress with one of them.
+	Compression string
+
+	// Public key pin of the receiver, overrides the one in the URL fragment
+	Pin string
+	// File name reported to the receiver
+	Name string
+	// Total size for progress reports, 0 if unknown
+	Size int64
+
+	// Called as bytes are transferred
+	Progress func(Progress)
+	// Called when a tunnel cannot forward a sender, e.g. because its local
+	// service is down. The sender's connection is closed.
+	TunnelError func(error)
+}
+
+// Progress reports a transfer in flight
+type Progress struct {
+	Transferred int64
+	// Total size, 0 if unknown
+	Total int64
+}
+
+// DefaultOptions returns the options of the public relay
+func DefaultOptions() Options {
+	return Options{
+		ServerAddress:    "bie.mlops.ninja:80",
+		Domain:           "bie.mlops.ninja",
+		Port:             443,
+		DialTimeout:      30 * time.Second,
+		CertLifetime:     30 * time.Minute,
+		Transport:        transport.TLS,
+		ReconnectTimeout: 2 * time.Minute,
+		Compression:      CompressAuto,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if o.ServerAddress == "" {
+		o.ServerAddress = defaults.ServerAddress
+	}
+	if o.Domain == "" {
+		o.Domain = defaults.Domain
+	}
+	if o.Port == 0 {
+		o.Port = defaults.Port
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = defaults.DialTimeout
+	}
+	if o.CertLifetime == 0 {
+		o.CertLifetime = defaults.CertLifetime
+	}
+	if o.Transport == "" {
+		o.Transport = defaults.Transport
+	}
+	if o.ReconnectTimeout == 0 {
+		o.ReconnectTimeout = defaults.ReconnectTimeout
+	}
+	if o.Compression == "" {
+		o.Compression = defaults.Compression
+	}
+	return o
+}
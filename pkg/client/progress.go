@@ -0,0 +1,26 @@
+package client
+
+import "io"
+
+// progressReader reports the bytes read through it
+type progressReader struct {
+	r        io.Reader
+	progress Progress
+	report   func(Progress)
+}
+
+func withProgress(r io.Reader, total int64, report func(Progress)) io.Reader {
+	if report == nil {
+		return r
+	}
+	return &progressReader{r: r, progress: Progress{Total: total}, report: report}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.progress.Transferred += int64(n)
+		p.report(p.progress)
+	}
+	return n, err
+}
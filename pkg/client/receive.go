@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"bie/pkg/biecy"
+	"bie/pkg/bietrace"
+	"bie/pkg/biewire"
+	"bie/pkg/osserver"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var errNoUpload = errors.New("sender left without uploading a file")
+
+// Receiver waits for one sender to upload a file
+type Receiver struct {
+	*Session
+}
+
+// Receive registers on the relay. Hand the sender Receiver.ShareURL (or
+// Code), then call Save or Copy to wait for the file. With Options.Parallel
+// the sender may upload it in chunks over that many connections, which Copy
+// only takes when its writer is an io.WriterAt. Compressed uploads are
+// decompressed on the fly.
+func Receive(ctx context.Context, opts Options) (*Receiver, error) {
+	intention := biewire.IntentionGet
+	if opts.Parallel > 1 {
+		if opts.Code {
+			return nil, errors.New("transfer codes pair a single connection, they cannot be used with parallel transfers")
+		}
+		// Every connection of the sender is a sender of its own to the relay
+		intention = biewire.IntentionTunnel
+		if opts.MaxConcurrent == 0 {
+			opts.MaxConcurrent = opts.Parallel
+		}
+	}
+
+	s, err := register(ctx, opts, intention, "/file")
+	if err != nil {
+		return nil, err
+	}
+	if opts.Parallel > 1 {
+		s.parallel = opts.Parallel
+	}
+	s.encodings = acceptedEncodings(s.opts.Compression)
+	return &Receiver{Session: s}, nil
+}
+
+// Save waits for the upload and writes it to path. The file is created only
+// once the sender starts uploading and removed if the transfer fails.
+func (r *Receiver) Save(ctx context.Context, path string) error {
+	var out *os.File
+	_, err := r.receive(ctx, func() (io.Writer, error) {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+		return f, nil
+	})
+
+	if out != nil {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}
+	return err
+}
+
+// Copy waits for the upload and writes it to w
+func (r *Receiver) Copy(ctx context.Context, w io.Writer) (int64, error) {
+	return r.receive(ctx, func() (io.Writer, error) { return w, nil })
+}
+
+func (r *Receiver) receive(ctx context.Context, open func() (io.Writer, error)) (int64, error) {
+	defer r.Close()
+	stop := r.closeOnDone(ctx)
+	defer stop()
+
+	ctx, span := bietrace.Tracer().Start(r.traceContext(ctx), "bie.receive")
+	var report biewire.TransferReport
+	var err error
+	defer func() {
+		span.SetAttributes(
+			attribute.Int64("bie.bytes", report.Bytes),
+			attribute.Int64("bie.logical_bytes", report.LogicalBytes),
+			attribute.String("bie.encoding", report.Encoding),
+		)
+		bietrace.End(span, err)
+	}()
+	if r.parallel > 1 {
+		report, err = r.receiveChunked(ctx, open)
+	} else {
+		report, err = r.receiveOne(ctx, open)
+	}
+	if err == nil {
+		r.reportTransfer(report)
+	}
+	return report.LogicalBytes, err
+}
+
+// receiveOne serves the single sender of the registration
+func (r *Receiver) receiveOne(ctx context.Context, open func() (io.Writer, error)) (biewire.TransferReport, error) {
+	var report biewire.TransferReport
+	conn, err := r.acceptConn()
+	if err != nil {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		return report, err
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return report, fmt.Errorf("server TLS handshake failed: %w", err)
+		}
+	}
+
+	result := errNoUpload
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, req *http.Request) {
+		report, result = r.handleUpload(w, req, open)
+	})
+
+	server := osserver.NewOneShotServer(conn, traceHandler(ctx, mux))
+	if err := server.Serve(ctx); err != nil {
+		return report, fmt.Errorf("server error: %w", err)
+	}
+	return report, result
+}
+
+// handleUpload streams the "file" form field to the writer returned by open,
+// decompressing it if the part has a Content-Encoding
+func (r *Receiver) handleUpload(w http.ResponseWriter, req *http.Request, open func() (io.Writer, error)) (biewire.TransferReport, error) {
+	var report biewire.TransferReport
+	if req.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return report, fmt.Errorf("sender used method %s", req.Method)
+	}
+
+	form, err := req.MultipartReader()
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return report, fmt.Errorf("upload is not a multipart form: %w", err)
+	}
+	part, err := form.NextPart()
+	for err == nil && part.FormName() != "file" {
+		part, err = form.NextPart()
+	}
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return report, errNoUpload
+	}
+	defer part.Close()
+
+	var src io.Reader = part
+	if r.Key != nil {
+		if src, err = biecy.DecryptReader(part, r.Key); err != nil {
+			http.Error(w, "File is not encrypted, use bie send with the full URL", http.StatusBadRequest)
+			return report, err
+		}
+	}
+	// The request size includes the form and encryption overhead, close
+	// enough. Compressed, it is the size on the wire that counts.
+	wire := &countingReader{r: withProgress(src, max(req.ContentLength, 0), r.opts.Progress)}
+	report.Encoding = part.Header.Get("Content-Encoding")
+	decoded, err := decompressReader(wire, report.Encoding)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return report, err
+	}
+	defer decoded.Close()
+
+	dst, err := open()
+	if err != nil {
+		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		return report, err
+	}
+	report.LogicalBytes, err = io.Copy(dst, decoded)
+	report.Bytes = wire.n
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to receive file: %v", err), http.StatusBadRequest)
+		return report, err
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "File %s successfully transferred\n", part.FileName())
+	return report, nil
+}
+
+// reportTransfer tells the relay what a transfer took on the wire and on
+// disk, for its log. Older relays do not take reports.
+func (r *Receiver) reportTransfer(report biewire.TransferReport) {
+	if !r.reports {
+		return
+	}
+	stream, err := r.current().OpenStream()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	biewire.SendJSON(stream, biewire.ClientRequest{Intention: biewire.IntentionReport, Transfer: &report})
+}
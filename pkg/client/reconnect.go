@@ -0,0 +1,74 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"bie/pkg/transport"
+)
+
+// Backoff between attempts to reach the relay again
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// reconnect resumes the registration over a new connection after broken
+// dropped, retrying with backoff for Options.ReconnectTimeout. It fails
+// right away once the session was closed or the relay gave up the token.
+func (s *Session) reconnect(broken transport.Session) error {
+	broken.Close()
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	if s.opts.ReconnectTimeout < 0 || s.resumeSecret == "" {
+		return errors.New("reconnecting is disabled")
+	}
+
+	// Another caller may have reconnected already, or is doing so, in which
+	// case we wait for its session
+	s.reconnectMu.Lock()
+	defer s.reconnectMu.Unlock()
+	if s.current() != broken {
+		return nil
+	}
+
+	req := s.request
+	req.ResumeToken = s.Token
+	req.ResumeSecret = s.resumeSecret
+
+	deadline := time.Now().Add(s.opts.ReconnectTimeout)
+	delay := minReconnectDelay
+	for {
+		session, resp, err := requestRegistration(s.ctx, s.opts, req)
+		if err == nil && resp.Token != s.Token {
+			session.Close()
+			err = fmt.Errorf("%w: resumed a different token", errRefused)
+		}
+		if err == nil {
+			s.mu.Lock()
+			s.session = session
+			s.mu.Unlock()
+			// Close may have raced with us, don't leave the new session behind
+			if s.ctx.Err() != nil {
+				session.Close()
+				return s.ctx.Err()
+			}
+			return nil
+		}
+		if errors.Is(err, errRefused) {
+			return err
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("failed to reconnect: %w", err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
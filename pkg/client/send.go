@@ -0,0 +1,247 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"bie/pkg/biecy"
+	"bie/pkg/biepake"
+	"bie/pkg/bietrace"
+	"bie/pkg/biewire"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Send uploads r to the receiver at rawURL, as returned by
+// Session.ShareURL. The pin and the encryption key are taken from the URL
+// fragment, opts.Pin overrides the pin. Without a pin the receiver uses relay
+// TLS and the relay's certificate is verified as usual. When the receiver
+// advertises parallelism and r is an io.ReaderAt of opts.Size bytes, the
+// file goes in chunks over as many connections, capped by opts.Parallel.
+// The file is compressed with an encoding the receiver advertises, as
+// opts.Compression allows.
+func Send(ctx context.Context, rawURL string, r io.Reader, opts Options) (err error) {
+	ctx, span := bietrace.Tracer().Start(ctx, "bie.send")
+	defer func() { bietrace.End(span, err) }()
+
+	opts = opts.withDefaults()
+
+	uploadURL, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	fragment, err := url.ParseQuery(uploadURL.EscapedFragment())
+	if err != nil {
+		return fmt.Errorf("invalid URL fragment: %w", err)
+	}
+	uploadURL.Fragment = ""
+
+	pin := opts.Pin
+	if pin == "" {
+		pin = fragment.Get("pin")
+	}
+
+	var streamKey []byte
+	if fragment.Has("key") {
+		if streamKey, err = biecy.ParseStreamKey(fragment.Get("key")); err != nil {
+			return fmt.Errorf("invalid URL: %w", err)
+		}
+	}
+
+	client := http.DefaultClient
+	if pin != "" {
+		verifyPin, err := biecy.VerifyPin(pin)
+		if err != nil {
+			return fmt.Errorf("invalid pin: %w", err)
+		}
+		// The receiver's certificate is one-shot, trust it by pin only
+		client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					VerifyConnection:   verifyPin,
+				},
+			},
+		}
+	}
+
+	encodings := parseEncodings(fragment.Get("encodings"))
+	parallel, _ := strconv.Atoi(fragment.Get("parallel"))
+	if opts.Parallel > 0 {
+		parallel = min(parallel, opts.Parallel)
+	}
+	if ra, ok := r.(io.ReaderAt); ok && parallel > 1 && opts.Size > chunkSize && opts.Size <= maxChunkedSize {
+		client = parallelClient(client, parallel)
+		err := uploadChunked(ctx, client, uploadURL.String(), ra, streamKey, encodings, opts, parallel)
+		if !errors.Is(err, errChunkedRefused) {
+			return err
+		}
+		r = io.NewSectionReader(ra, 0, opts.Size)
+	}
+	return upload(ctx, client, uploadURL.String(), r, streamKey, encodings, opts)
+}
+
+// SendCode uploads r to the receiver holding the transfer code. The relay
+// pairs us by the code's nameplate, the receiver's pin is learnt from the
+// code handshake.
+func SendCode(ctx context.Context, code string, r io.Reader, opts Options) (err error) {
+	ctx, span := bietrace.Tracer().Start(ctx, "bie.send", trace.WithAttributes(attribute.Bool("bie.code", true)))
+	defer func() { bietrace.End(span, err) }()
+
+	opts = opts.withDefaults()
+
+	parsed, err := biepake.ParseCode(code)
+	if err != nil {
+		return fmt.Errorf("invalid code: %w", err)
+	}
+
+	session, stream, err := dialRelay(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	req := biewire.ClientRequest{Intention: biewire.IntentionSend, Nameplate: parsed.Nameplate, TraceParent: bietrace.Inject(ctx)}
+	if err := biewire.SendJSON(stream, req); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	var resp biewire.ClientResponse
+	if err := biewire.ReceiveJSON(stream, &resp); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("relay refused code: %s", resp.Error)
+	}
+
+	pin, err := biepake.SenderHandshake(stream, parsed)
+	if err != nil {
+		return fmt.Errorf("transfer code handshake failed: %w", err)
+	}
+	verifyPin, err := biecy.VerifyPin(pin)
+	if err != nil {
+		return fmt.Errorf("receiver sent an invalid pin: %w", err)
+	}
+
+	// The stream carries exactly one TLS connection to the receiver
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				tlsConn := tls.Client(stream, &tls.Config{
+					InsecureSkipVerify: true,
+					VerifyConnection:   verifyPin,
+				})
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	// The code does not tell which encodings the receiver takes
+	return upload(ctx, client, "https://"+opts.Domain+"/file", r, nil, nil, opts)
+}
+
+// upload posts r as the "file" form field, streaming the multipart body.
+// With a stream key the data is encrypted before it leaves this machine,
+// compressed first with one of the encodings the receiver accepts.
+func upload(ctx context.Context, client *http.Client, target string, r io.Reader, streamKey []byte, encodings []string, opts Options) error {
+	r = withProgress(r, opts.Size, opts.Progress)
+	name := opts.Name
+	if name == "" {
+		name = "file"
+	}
+
+	var sample []byte
+	if len(encodings) > 0 && opts.Compression == CompressAuto {
+		r, sample = peekSample(r)
+	}
+	encoding := pickEncoding(opts.Compression, encodings, sample)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, quoteEscaper.Replace(name)))
+	header.Set("Content-Type", "application/octet-stream")
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreatePart(header)
+		if err == nil {
+			err = copyEncoded(part, r, streamKey, encoding)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	bietrace.InjectHeader(ctx, req.Header)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("upload rejected: %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+// Escapes a file name in Content-Disposition, like CreateFormFile
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// copyEncoded copies src to dst compressed with encoding, if any, then
+// encrypted with streamKey, if any
+func copyEncoded(dst io.Writer, src io.Reader, streamKey []byte, encoding string) error {
+	var closers []io.Closer
+	if streamKey != nil {
+		enc, err := biecy.EncryptWriter(dst, streamKey)
+		if err != nil {
+			return err
+		}
+		dst = enc
+		closers = append(closers, enc)
+	}
+	if encoding != "" {
+		comp, err := compressWriter(dst, encoding)
+		if err != nil {
+			return err
+		}
+		dst = comp
+		closers = append(closers, comp)
+	}
+
+	_, err := io.Copy(dst, src)
+	// Innermost first, the compressor flushes into the encryption. Closing
+	// after an error too releases the compressor's goroutines.
+	for i := len(closers) - 1; i >= 0; i-- {
+		if closeErr := closers[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sync"
+
+	"bie/pkg/biewire"
+	"bie/pkg/osserver"
+)
+
+// Server shares files with senders through the relay
+type Server struct {
+	*Session
+	done chan struct{}
+	err  error
+}
+
+// Serve registers on the relay and serves fsys at Server.ShareURL in the
+// background until ctx is done. Files are fetched with plain GET requests,
+// e.g. curl with --pinnedpubkey, over as many connections as the relay and
+// Options.MaxConcurrent allow.
+func Serve(ctx context.Context, fsys fs.FS, opts Options) (*Server, error) {
+	if opts.Code {
+		return nil, fmt.Errorf("transfer codes are %w", errUnsupported)
+	}
+	if opts.Encrypt {
+		return nil, fmt.Errorf("encryption is %w", errUnsupported)
+	}
+
+	s, err := register(ctx, opts, biewire.IntentionTunnel, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{Session: s, done: make(chan struct{})}
+	go srv.serve(ctx, fsys)
+	return srv, nil
+}
+
+// Wait blocks until serving stopped, the error is nil if ctx ended it
+func (s *Server) Wait() error {
+	<-s.done
+	return s.err
+}
+
+func (s *Server) serve(ctx context.Context, fsys fs.FS) {
+	defer close(s.done)
+	defer s.Close()
+	stop := s.closeOnDone(ctx)
+	defer stop()
+
+	listener := osserver.NewConnListener(s.current().LocalAddr())
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := s.acceptConn()
+			if err != nil {
+				return
+			}
+			if err := listener.Push(conn); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	var handler http.Handler = http.FileServerFS(fsys)
+	if s.opts.Progress != nil {
+		handler = progressHandler(handler, s.opts.Progress)
+	}
+	httpSrv := &http.Server{Handler: handler}
+	err := httpSrv.Serve(listener)
+	httpSrv.Close()
+
+	if ctx.Err() == nil && !errors.Is(err, http.ErrServerClosed) {
+		s.err = fmt.Errorf("registration ended: %w", err)
+	}
+}
+
+// progressHandler reports the bytes of all responses served
+func progressHandler(next http.Handler, report func(Progress)) http.Handler {
+	var mu sync.Mutex
+	var progress Progress
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&countingWriter{ResponseWriter: w, count: func(n int) {
+			mu.Lock()
+			progress.Transferred += int64(n)
+			current := progress
+			mu.Unlock()
+			report(current)
+		}}, r)
+	})
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	count func(int)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if n > 0 {
+		w.count(n)
+	}
+	return n, err
+}
@@ -0,0 +1,332 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bie/pkg/biecy"
+	"bie/pkg/biepake"
+	"bie/pkg/bietrace"
+	"bie/pkg/biewire"
+	"bie/pkg/transport"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Session is a registration on the relay, reachable by senders through it
+type Session struct {
+	// Token identifying the registration on the relay
+	Token string
+	// URL senders connect to
+	URL string
+	// Public key pin of the one-shot certificate senders have to trust,
+	// empty with Options.RelayTLS
+	Pin string
+	// CA of the one-shot certificate, for clients that cannot pin
+	CACertPEM []byte
+	// Transfer code, when registered with Options.Code
+	Code string
+	// End-to-end encryption key, when registered with Options.Encrypt
+	Key []byte
+
+	opts      Options
+	tlsConfig *tls.Config
+	code      biepake.Code
+	// Connections a chunked upload may use, advertised in ShareURL
+	parallel int
+	// Content encodings we decompress, advertised in ShareURL
+	encodings []string
+	// The relay takes transfer reports
+	reports bool
+	// Span of the registration, parent of the transfer's spans unless the
+	// caller has one
+	trace trace.SpanContext
+
+	// Registration request and secret to resume it after reconnecting
+	request      biewire.ClientRequest
+	resumeSecret string
+	// Ends reconnection attempts on Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	session transport.Session
+	// Held by the one caller resuming the registration at a time
+	reconnectMu sync.Mutex
+}
+
+// ShareURL returns URL with the pin, encryption key, parallelism and content
+// encodings in its fragment, everything Send needs. The fragment never
+// reaches the relay.
+func (s *Session) ShareURL() string {
+	fragment := url.Values{}
+	if s.Pin != "" {
+		fragment.Set("pin", s.Pin)
+	}
+	if s.Key != nil {
+		fragment.Set("key", biecy.FormatStreamKey(s.Key))
+	}
+	if s.parallel > 1 {
+		fragment.Set("parallel", strconv.Itoa(s.parallel))
+	}
+	if len(s.encodings) > 0 {
+		fragment.Set("encodings", strings.Join(s.encodings, ","))
+	}
+	if len(fragment) == 0 {
+		return s.URL
+	}
+	return s.URL + "#" + fragment.Encode()
+}
+
+// Close drops the registration
+func (s *Session) Close() error {
+	s.cancel()
+	return s.current().Close()
+}
+
+// current returns the session to the relay, which changes on reconnects
+func (s *Session) current() transport.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session
+}
+
+// register gets a token from the relay and prepares the one-shot certificate
+// for it, senders will reach us at path
+func register(ctx context.Context, opts Options, intention, path string) (_ *Session, err error) {
+	ctx, span := bietrace.Tracer().Start(ctx, "bie.register", trace.WithAttributes(attribute.String("bie.intention", intention)))
+	defer func() { bietrace.End(span, err) }()
+
+	opts = opts.withDefaults()
+	if opts.Code && opts.RelayTLS {
+		return nil, errors.New("transfer codes need end-to-end TLS, they cannot be used with relay TLS")
+	}
+
+	req := biewire.ClientRequest{
+		AuthToken:     opts.AuthToken,
+		Intention:     intention,
+		Code:          opts.Code,
+		MaxConcurrent: opts.MaxConcurrent,
+		MaxTotal:      opts.MaxTotal,
+		RelayTLS:      opts.RelayTLS,
+		HalfClose:     true,
+		TraceParent:   bietrace.Inject(ctx),
+	}
+	session, resp, err := requestRegistration(ctx, opts, req)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		Token:        resp.Token,
+		opts:         opts,
+		request:      req,
+		resumeSecret: resp.ResumeSecret,
+		reports:      resp.TransferReports,
+		trace:        span.SpanContext(),
+		session:      session,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	bieDomain := resp.Token + "." + opts.Domain
+	s.URL = fmt.Sprintf("https://%s:%d%s", bieDomain, opts.Port, path)
+
+	// Our own certificate for the server role, senders trust it by pin.
+	// With relay TLS senders trust the relay's certificate instead.
+	if !opts.RelayTLS {
+		ca, serverCert, err := biecy.GenerateServerCert(bieDomain, biecy.WithLifetime(opts.CertLifetime))
+		if err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to generate certificate: %w", err)
+		}
+		cert, err := tls.X509KeyPair(serverCert.CertPEM, serverCert.KeyPEM)
+		if err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		s.Pin = serverCert.Pin()
+		s.CACertPEM = ca.CertPEM
+	}
+
+	// The password of the transfer code never leaves us, the relay only
+	// knows the nameplate
+	if opts.Code {
+		password, err := biepake.NewPassword()
+		if err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to generate transfer code: %w", err)
+		}
+		s.code = biepake.Code{Nameplate: resp.Nameplate, Password: password}
+		s.Code = s.code.String()
+	}
+
+	// The key only travels in the URL fragment
+	if opts.Encrypt {
+		if s.Key, err = biecy.NewStreamKey(); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// requestRegistration connects to the relay and sends req on the auth stream
+func requestRegistration(ctx context.Context, opts Options, req biewire.ClientRequest) (transport.Session, biewire.ClientResponse, error) {
+	var resp biewire.ClientResponse
+	session, authStream, err := dialRelay(ctx, opts)
+	if err != nil {
+		return nil, resp, err
+	}
+	defer authStream.Close()
+
+	if err := biewire.SendJSON(authStream, req); err != nil {
+		session.Close()
+		return nil, resp, fmt.Errorf("failed to send request: %w", err)
+	}
+	if err := biewire.ReceiveJSON(authStream, &resp); err != nil {
+		session.Close()
+		return nil, resp, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.Error != "" {
+		session.Close()
+		return nil, resp, fmt.Errorf("%w: %s", errRefused, resp.Error)
+	}
+	// Older relays do not frame streams for half-closes
+	if resp.HalfClose {
+		session = transport.WithHalfClose(session)
+	}
+	return session, resp, nil
+}
+
+// acceptConn waits for the next sender and returns the TLS connection to it,
+// after the transfer code handshake if there is a code. With relay TLS the
+// relay already decrypted it and the stream is returned as is. If the
+// connection to the relay drops meanwhile, the registration is resumed.
+func (s *Session) acceptConn() (net.Conn, error) {
+	var stream net.Conn
+	for {
+		session := s.current()
+		var err error
+		if stream, err = session.AcceptStream(); err == nil {
+			break
+		}
+		if resumeErr := s.reconnect(session); resumeErr != nil {
+			return nil, fmt.Errorf("failed to accept stream: %w", err)
+		}
+	}
+
+	if s.Code != "" {
+		if err := biepake.ReceiverHandshake(stream, s.code, s.Pin); err != nil {
+			stream.Close()
+			return nil, fmt.Errorf("transfer code handshake failed: %w", err)
+		}
+	}
+
+	if s.tlsConfig == nil {
+		return stream, nil
+	}
+	return tls.Server(stream, s.tlsConfig), nil
+}
+
+// closeOnDone drops the registration when ctx is done, call the returned
+// function to stop watching
+func (s *Session) closeOnDone(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() { s.Close() })
+}
+
+// How long the auto transport waits for QUIC before falling back to TLS
+const quicFallbackTimeout = 3 * time.Second
+
+// dialRelay connects to the relay over the transport of opts and opens the
+// auth stream
+func dialRelay(ctx context.Context, opts Options) (transport.Session, net.Conn, error) {
+	if err := transport.Check(opts.Transport); err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	if opts.TLSConfig != nil {
+		tlsConfig = opts.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = opts.Domain // Required for SNI and certificate validation
+	}
+
+	session, err := dialSession(ctx, opts, tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	authStream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, nil, fmt.Errorf("failed to open auth stream: %w", err)
+	}
+	return session, authStream, nil
+}
+
+func dialSession(ctx context.Context, opts Options, tlsConfig *tls.Config) (transport.Session, error) {
+	switch opts.Transport {
+	case transport.QUIC:
+		return transport.DialQUIC(ctx, opts.ServerAddress, tlsConfig, opts.DialTimeout)
+	case transport.Auto:
+		timeout := min(opts.DialTimeout, quicFallbackTimeout)
+		if session, err := transport.DialQUIC(ctx, opts.ServerAddress, tlsConfig, timeout); err == nil {
+			return session, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if opts.Transport == transport.WebSocket {
+		conn, err = transport.DialWebSocket(ctx, opts.ServerAddress, tlsConfig, opts.DialTimeout)
+	} else {
+		conn, err = dialTLS(ctx, opts.ServerAddress, tlsConfig, opts.DialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := transport.SmuxClient(conn, opts.Smux)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func dialTLS(ctx context.Context, addr string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	rawConn, err := transport.DialTCP(ctx, addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("TCP connection failed: %w", err)
+	}
+	conn := tls.Client(rawConn, tlsConfig)
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := conn.HandshakeContext(handshakeCtx); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("TLS connection failed: %w", err)
+	}
+	return conn, nil
+}
+
+var (
+	errRefused           = errors.New("relay refused registration")
+	errUnsupported       = errors.New("not supported when serving files")
+	errUnsupportedTunnel = errors.New("not supported by tunnels")
+)
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"bie/pkg/bietrace"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceContext returns ctx with the registration's span as parent of new
+// spans, unless ctx has a span of its own
+func (s *Session) traceContext(ctx context.Context) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	return trace.ContextWithSpanContext(ctx, s.trace)
+}
+
+// traceHandler serves every request of a sender in a span under the one in
+// ctx, linked to the sender's span if the request carries one
+func traceHandler(ctx context.Context, next http.Handler) http.Handler {
+	parent := trace.SpanContextFromContext(ctx)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		opts := []trace.SpanStartOption{
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("url.path", req.URL.Path),
+			),
+		}
+		if link, ok := bietrace.LinkFromHeader(req.Header); ok {
+			opts = append(opts, trace.WithLinks(link))
+		}
+		spanCtx, span := bietrace.Tracer().Start(trace.ContextWithSpanContext(req.Context(), parent), "bie.http "+req.Method, opts...)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req.WithContext(spanCtx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// statusRecorder remembers the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"bie/pkg/biewire"
+	"bie/pkg/transport"
+)
+
+// DefaultTunnelCertLifetime is the certificate validity of tunnels when
+// Options.CertLifetime is not set, tunnels outlive one-shot transfers
+const DefaultTunnelCertLifetime = 24 * time.Hour
+
+// Tunnel exposes a local TCP service through the relay. TLS is terminated
+// here, the relay only sees encrypted bytes.
+type Tunnel struct {
+	*Session
+	// Local address every sender connection is forwarded to
+	LocalAddr string
+	done      chan struct{}
+	err       error
+}
+
+// OpenTunnel registers on the relay and forwards every sender connection to
+// localAddr in the background until ctx is done. Unlike one-shot transfers,
+// the registration accepts any number of senders.
+func OpenTunnel(ctx context.Context, localAddr string, opts Options) (*Tunnel, error) {
+	if opts.Code {
+		return nil, fmt.Errorf("transfer codes are %w", errUnsupportedTunnel)
+	}
+	if opts.Encrypt {
+		return nil, fmt.Errorf("encryption is %w", errUnsupportedTunnel)
+	}
+	if opts.CertLifetime == 0 {
+		opts.CertLifetime = DefaultTunnelCertLifetime
+	}
+
+	s, err := register(ctx, opts, biewire.IntentionTunnel, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tunnel{Session: s, LocalAddr: localAddr, done: make(chan struct{})}
+	go t.serve(ctx)
+	return t, nil
+}
+
+// Wait blocks until the tunnel is down, the error is nil if ctx ended it
+func (t *Tunnel) Wait() error {
+	<-t.done
+	return t.err
+}
+
+func (t *Tunnel) serve(ctx context.Context) {
+	defer close(t.done)
+	defer t.Close()
+	stop := t.closeOnDone(ctx)
+	defer stop()
+
+	for {
+		conn, err := t.acceptConn()
+		if err != nil {
+			if ctx.Err() == nil {
+				t.err = fmt.Errorf("registration ended: %w", err)
+			}
+			return
+		}
+		go t.forward(ctx, conn)
+	}
+}
+
+// forward proxies one sender connection to the local service
+func (t *Tunnel) forward(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	dialer := &net.Dialer{Timeout: t.opts.DialTimeout}
+	local, err := dialer.DialContext(ctx, "tcp", t.LocalAddr)
+	if err != nil {
+		if t.opts.TunnelError != nil && ctx.Err() == nil {
+			t.opts.TunnelError(fmt.Errorf("failed to reach local service: %w", err))
+		}
+		return
+	}
+	defer local.Close()
+
+	// Half-closes pass through, so a sender that is done sending still gets
+	// the service's answer
+	transport.Pipe(conn, local, transport.PipeTimeouts{})
+}
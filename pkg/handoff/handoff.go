@@ -0,0 +1,388 @@
+package handoff
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoPredecessor is returned by Inherit when no relay is listening on the
+// upgrade socket, i.e. this is a cold start.
+var ErrNoPredecessor = errors.New("no predecessor to inherit from")
+
+const (
+	maxPacketSize = 4096
+	maxFiles      = 16
+)
+
+// Kinds of the packets successor and predecessor exchange after the handoff,
+// in their first byte
+const (
+	// A connection the successor could not serve, its fd attached
+	kindConn byte = iota
+	// A call of the successor and the predecessor's reply, JSON follows
+	kindCall
+	kindReply
+)
+
+// callMsg is a call or its reply
+type callMsg struct {
+	ID    uint64          `json:"id"`
+	Body  json.RawMessage `json:"body,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// listenersMsg describes the files attached to the handoff packet, in order
+type listenersMsg struct {
+	Names []string `json:"names"`
+}
+
+// Server waits on the upgrade socket for a successor process
+type Server struct {
+	ln *net.UnixListener
+}
+
+// Listen binds the upgrade socket at path, replacing a stale one if present
+func Listen(path string) (*Server, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale upgrade socket: %w", err)
+	}
+
+	ln, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on upgrade socket: %w", err)
+	}
+	// The successor rebinds the same path, we must not unlink its socket
+	ln.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to restrict upgrade socket: %w", err)
+	}
+
+	return &Server{ln: ln}, nil
+}
+
+// Accept blocks until a successor connects, hands it the listener files and
+// returns a Successor through which it forwards connections back to us.
+// Connections from other users are rejected.
+func (s *Server) Accept(files map[string]*os.File) (*Successor, error) {
+	for {
+		conn, err := s.ln.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkPeer(conn); err != nil {
+			conn.Close()
+			continue
+		}
+
+		if err := sendFiles(conn, files); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to send listeners: %w", err)
+		}
+
+		return &Successor{conn: conn}, nil
+	}
+}
+
+// Close stops listening on the upgrade socket
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+// Successor is the process that took over our listeners
+type Successor struct {
+	conn *net.UnixConn
+}
+
+// Serve hands the connections the successor could not serve itself to
+// serveConn, and answers its calls with what handle returns for their
+// bodies, until the link is closed
+func (s *Successor) Serve(serveConn func(net.Conn), handle func(body json.RawMessage) (any, error)) error {
+	buf := make([]byte, maxPacketSize)
+	oob := make([]byte, unix.CmsgSpace(4))
+	for {
+		n, oobn, _, _, err := s.conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errors.New("empty packet from successor")
+		}
+
+		switch buf[0] {
+		case kindConn:
+			conn, err := receiveConn(oob[:oobn])
+			if err != nil {
+				return err
+			}
+			serveConn(conn)
+		case kindCall:
+			var call callMsg
+			if err := json.Unmarshal(buf[1:n], &call); err != nil {
+				return fmt.Errorf("invalid call from successor: %w", err)
+			}
+			go s.reply(call, handle)
+		default:
+			return fmt.Errorf("unknown packet kind %d from successor", buf[0])
+		}
+	}
+}
+
+func (s *Successor) reply(call callMsg, handle func(body json.RawMessage) (any, error)) {
+	reply := callMsg{ID: call.ID}
+	result, err := handle(call.Body)
+	if err == nil {
+		reply.Body, err = json.Marshal(result)
+	}
+	if err != nil {
+		reply.Body, reply.Error = nil, err.Error()
+	}
+	// The successor fails the call when the link drops, nothing to do here
+	writeMsg(s.conn, kindReply, reply)
+}
+
+func receiveConn(oob []byte) (net.Conn, error) {
+	fds, err := parseRights(oob)
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		closeFds(fds)
+		return nil, fmt.Errorf("expected 1 forwarded connection, got %d", len(fds))
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "forwarded")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// Close drops the link to the successor, after which it serves every
+// connection itself
+func (s *Successor) Close() error {
+	return s.conn.Close()
+}
+
+// Predecessor is the process we took the listeners over from. It is still
+// serving the receivers registered before the upgrade.
+type Predecessor struct {
+	conn *net.UnixConn
+
+	mu      sync.Mutex
+	lastID  uint64
+	pending map[uint64]chan callMsg
+	// Why the link is gone, calls fail with it
+	err error
+}
+
+// ErrLinkClosed is returned by calls once the predecessor is gone
+var ErrLinkClosed = errors.New("link to predecessor closed")
+
+// Inherit connects to the relay listening on the upgrade socket at path and
+// takes over its listeners, keyed by name
+func Inherit(path string) (*Predecessor, map[string]*os.File, error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, nil, ErrNoPredecessor
+		}
+		return nil, nil, fmt.Errorf("failed to connect to upgrade socket: %w", err)
+	}
+
+	files, err := receiveFiles(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to receive listeners: %w", err)
+	}
+
+	p := &Predecessor{conn: conn, pending: make(map[uint64]chan callMsg)}
+	go p.readReplies()
+	return p, files, nil
+}
+
+// Call asks the predecessor to handle req, see Successor.Serve, and decodes
+// its reply into reply. Errors of the handler come back as is.
+func (p *Predecessor) Call(ctx context.Context, req, reply any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan callMsg, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return p.err
+	}
+	p.lastID++
+	id := p.lastID
+	p.pending[id] = done
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	if err := writeMsg(p.conn, kindCall, callMsg{ID: id, Body: body}); err != nil {
+		return err
+	}
+
+	select {
+	case msg, ok := <-done:
+		if !ok {
+			return ErrLinkClosed
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		return json.Unmarshal(msg.Body, reply)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readReplies passes the predecessor's replies to their calls until the link
+// drops, which fails the calls still waiting
+func (p *Predecessor) readReplies() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil || n == 0 {
+			break
+		}
+		var msg callMsg
+		if buf[0] != kindReply || json.Unmarshal(buf[1:n], &msg) != nil {
+			continue
+		}
+		p.mu.Lock()
+		if done, ok := p.pending[msg.ID]; ok {
+			done <- msg
+			delete(p.pending, msg.ID)
+		}
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = ErrLinkClosed
+	for id, done := range p.pending {
+		close(done)
+		delete(p.pending, id)
+	}
+}
+
+// Forward passes conn to the predecessor, which serves it as if it had
+// accepted it itself. Bytes peeked from conn are still unread.
+func (p *Predecessor) Forward(conn *net.TCPConn) error {
+	f, err := conn.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _, err = p.conn.WriteMsgUnix([]byte{kindConn}, unix.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// Close drops the link to the predecessor
+func (p *Predecessor) Close() error {
+	return p.conn.Close()
+}
+
+// writeMsg sends msg as one packet of kind
+func writeMsg(conn *net.UnixConn, kind byte, msg callMsg) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data)+1 > maxPacketSize {
+		return fmt.Errorf("message of %d bytes too large", len(data))
+	}
+	_, err = conn.Write(append([]byte{kind}, data...))
+	return err
+}
+
+func sendFiles(conn *net.UnixConn, files map[string]*os.File) error {
+	if len(files) > maxFiles {
+		return fmt.Errorf("too many listeners: %d", len(files))
+	}
+
+	var msg listenersMsg
+	fds := make([]int, 0, len(files))
+	for name, f := range files {
+		msg.Names = append(msg.Names, name)
+		fds = append(fds, int(f.Fd()))
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = conn.WriteMsgUnix(data, unix.UnixRights(fds...), nil)
+	return err
+}
+
+func receiveFiles(conn *net.UnixConn) (map[string]*os.File, error) {
+	buf := make([]byte, maxPacketSize)
+	oob := make([]byte, unix.CmsgSpace(maxFiles*4))
+
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	fds, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	var msg listenersMsg
+	if err := json.Unmarshal(buf[:n], &msg); err != nil {
+		closeFds(fds)
+		return nil, err
+	}
+	if len(msg.Names) != len(fds) {
+		closeFds(fds)
+		return nil, fmt.Errorf("got %d names for %d listeners", len(msg.Names), len(fds))
+	}
+
+	files := make(map[string]*os.File, len(fds))
+	for i, name := range msg.Names {
+		files[name] = os.NewFile(uintptr(fds[i]), name)
+	}
+	return files, nil
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	var fds []int
+	for _, m := range msgs {
+		rights, err := unix.ParseUnixRights(&m)
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
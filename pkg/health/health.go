@@ -0,0 +1,109 @@
+// Package health serves liveness and readiness probes as JSON, for
+// orchestrators like Kubernetes and for people debugging a relay.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Statuses of checks and reports
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check reports on one part of the process. It returns details shown in the
+// report, and an error when that part is unhealthy.
+type Check func(ctx context.Context) (details any, err error)
+
+// Result is the outcome of one check
+type Result struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Details any    `json:"details,omitempty"`
+}
+
+// Report is the outcome of all checks of a probe, ok only if all of them are
+type Report struct {
+	Status string            `json:"status"`
+	Time   time.Time         `json:"time"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Run runs checks concurrently. Checks still running after timeout fail,
+// 0 waits for them.
+func Run(ctx context.Context, checks map[string]Check, timeout time.Duration) Report {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	report := Report{Status: StatusOK, Time: time.Now().UTC(), Checks: make(map[string]Result, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := runCheck(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusFail
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+// runCheck runs check, giving up on it when ctx is done. A check that does
+// not return in time is left running in the background.
+func runCheck(ctx context.Context, check Check) Result {
+	done := make(chan Result, 1)
+	go func() {
+		details, err := check(ctx)
+		result := Result{Status: StatusOK, Details: details}
+		if err != nil {
+			result.Status, result.Error = StatusFail, err.Error()
+		}
+		done <- result
+	}()
+
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+		return Result{Status: StatusFail, Error: fmt.Sprintf("check did not finish: %v", ctx.Err())}
+	}
+}
+
+// Handler answers with the report of checks: 200 when all pass, 503
+// otherwise
+func Handler(checks map[string]Check, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Run(r.Context(), checks, timeout)
+
+		status := http.StatusOK
+		if report.Status != StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if r.Method == http.MethodHead {
+			return
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	})
+}
@@ -0,0 +1,51 @@
+package osserver
+
+import (
+	"net"
+	"sync"
+)
+
+// ConnListener is a net.Listener handing out connections pushed by the
+// caller, e.g. streams accepted from a multiplexed session
+type ConnListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewConnListener(addr net.Addr) *ConnListener {
+	return &ConnListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Push hands conn to the next Accept, it fails once the listener is closed
+func (l *ConnListener) Push(conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.done:
+		return net.ErrClosed
+	}
+}
+
+func (l *ConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *ConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *ConnListener) Addr() net.Addr {
+	return l.addr
+}
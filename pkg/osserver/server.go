@@ -39,16 +39,17 @@ func (l *singleConnListener) Addr() net.Addr {
 
 type OneShotServer struct {
 	conn net.Conn
-	mux  *http.ServeMux
+	mux  http.Handler
 	srv  *http.Server
 	done chan bool
 }
 
-func NewOneShotServer(conn net.Conn, mux *http.ServeMux) *OneShotServer {
+func NewOneShotServer(conn net.Conn, mux http.Handler) *OneShotServer {
 	return &OneShotServer{
 		conn: conn,
 		mux:  mux,
-		done: make(chan bool),
+		// Both the request and the server exit may signal
+		done: make(chan bool, 2),
 	}
 }
 
@@ -65,7 +66,12 @@ func (s *OneShotServer) Serve(ctx context.Context) error {
 		s.done <- true
 	}()
 
-	<-s.done
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.srv.Close()
+		return ctx.Err()
+	}
 	// Gracefull shutdown
 	return s.srv.Shutdown(ctx)
 }
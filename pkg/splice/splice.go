@@ -0,0 +1,37 @@
+// Package splice copies between connections without taking the bytes through
+// user space where the kernel allows it
+package splice
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// Copy copies from src to dst until EOF on src, like io.Copy. Between two
+// TCP connections on Linux the bytes are moved by splice(2) through a pipe
+// and never leave the kernel, anything else falls back to io.Copy. Unless
+// progress is nil, written bytes are added to it as they go, for watching
+// a copy that is still running.
+func Copy(dst, src net.Conn, progress *atomic.Int64) (int64, error) {
+	if progress == nil {
+		progress = new(atomic.Int64)
+	}
+	srcTCP, srcOK := src.(*net.TCPConn)
+	dstTCP, dstOK := dst.(*net.TCPConn)
+	if !srcOK || !dstOK {
+		return io.Copy(countingWriter{dst, progress}, src)
+	}
+	return spliceTCP(dstTCP, srcTCP, progress)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,86 @@
+package splice
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Capacity asked for the pipe between the sockets, the kernel may cap it
+// at /proc/sys/fs/pipe-max-size and keep its default of 64 KiB
+const pipeSize = 1 << 20
+
+// spliceTCP moves everything from src to dst through a pipe. Both splices
+// are non-blocking and wait for the sockets in the runtime poller, so
+// deadlines and Close interrupt them like regular reads and writes.
+func spliceTCP(dst, src *net.TCPConn, progress *atomic.Int64) (int64, error) {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var pipe [2]int
+	if err := unix.Pipe2(pipe[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return 0, os.NewSyscallError("pipe2", err)
+	}
+	defer unix.Close(pipe[0])
+	defer unix.Close(pipe[1])
+	unix.FcntlInt(uintptr(pipe[1]), unix.F_SETPIPE_SZ, pipeSize)
+
+	var written int64
+	for {
+		// Socket to pipe, the pipe is empty so EAGAIN means no data yet
+		var n int
+		var spliceErr error
+		err := srcRaw.Read(func(fd uintptr) bool {
+			n, spliceErr = splice(int(fd), pipe[1], pipeSize)
+			return spliceErr != unix.EAGAIN
+		})
+		if err == nil {
+			err = spliceErr
+		}
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, nil
+		}
+
+		// Pipe to socket, EAGAIN means its send buffer is full
+		for n > 0 {
+			var m int
+			err := dstRaw.Write(func(fd uintptr) bool {
+				m, spliceErr = splice(pipe[0], int(fd), n)
+				return spliceErr != unix.EAGAIN
+			})
+			if err == nil {
+				err = spliceErr
+			}
+			if err != nil {
+				return written, err
+			}
+			n -= m
+			written += int64(m)
+			progress.Add(int64(m))
+		}
+	}
+}
+
+func splice(in, out, max int) (int, error) {
+	for {
+		n, err := unix.Splice(in, nil, out, nil, max, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil && err != unix.EAGAIN {
+			return int(n), os.NewSyscallError("splice", err)
+		}
+		return int(n), err
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package splice
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// spliceTCP copies with io.Copy, there is no splice(2)
+func spliceTCP(dst, src *net.TCPConn, progress *atomic.Int64) (int64, error) {
+	return io.Copy(countingWriter{dst, progress}, src)
+}
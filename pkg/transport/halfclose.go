@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// WithHalfClose returns session with streams that support CloseWrite, for
+// receivers and relays that agreed on it at registration. QUIC streams do
+// natively. smux has no half-close, so every write on its streams is framed
+// with its length and an empty frame ends the direction.
+func WithHalfClose(session Session) Session {
+	s, ok := session.(smuxSession)
+	if !ok {
+		return session
+	}
+	return &halfCloseSession{s}
+}
+
+type halfCloseSession struct {
+	smuxSession
+}
+
+func (s *halfCloseSession) OpenStream() (net.Conn, error) {
+	stream, err := s.smuxSession.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &halfCloseStream{Conn: stream}, nil
+}
+
+func (s *halfCloseSession) AcceptStream() (net.Conn, error) {
+	stream, err := s.smuxSession.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return &halfCloseStream{Conn: stream}, nil
+}
+
+// Largest frame of a halfCloseStream, bigger writes are split
+const halfCloseFrameSize = 64 << 10
+
+// halfCloseStream frames the bytes of a smux stream, see WithHalfClose
+type halfCloseStream struct {
+	net.Conn
+
+	readMu    sync.Mutex
+	remaining int
+	readDone  bool
+
+	writeMu   sync.Mutex
+	buf       []byte
+	writeDone bool
+}
+
+func (s *halfCloseStream) Read(b []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	if s.remaining == 0 {
+		if s.readDone {
+			return 0, io.EOF
+		}
+		var header [4]byte
+		if _, err := io.ReadFull(s.Conn, header[:]); err != nil {
+			return 0, err
+		}
+		if s.remaining = int(binary.BigEndian.Uint32(header[:])); s.remaining == 0 {
+			s.readDone = true
+			return 0, io.EOF
+		}
+	}
+	if len(b) > s.remaining {
+		b = b[:s.remaining]
+	}
+	n, err := s.Conn.Read(b)
+	s.remaining -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *halfCloseStream) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.writeDone {
+		return 0, errWriteClosed
+	}
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), halfCloseFrameSize)
+		s.buf = binary.BigEndian.AppendUint32(s.buf[:0], uint32(n))
+		s.buf = append(s.buf, b[:n]...)
+		if _, err := s.Conn.Write(s.buf); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer we are done sending, its reads return io.EOF
+// while it can still write to us
+func (s *halfCloseStream) CloseWrite() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.writeDone {
+		return nil
+	}
+	s.writeDone = true
+	s.buf = nil
+	_, err := s.Conn.Write(make([]byte, 4))
+	return err
+}
+
+var errWriteClosed = errors.New("write on a stream closed for writing")
@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"bie/pkg/splice"
+)
+
+// PipeTimeouts bound how long Pipe keeps its connections, zero is no limit
+type PipeTimeouts struct {
+	// Time without a byte in either direction
+	Idle time.Duration
+	// Time since the pipe started
+	Total time.Duration
+}
+
+// PipeSummary describes a finished pipe, for logging
+type PipeSummary struct {
+	// Bytes copied from a to b and from b to a
+	AToB, BToA int64
+	Duration   time.Duration
+	// Why the pipe ended early: a copy's error, ErrIdleTimeout or
+	// ErrPipeTimeout. nil when both directions finished.
+	Err error
+}
+
+func (s PipeSummary) String() string {
+	text := fmt.Sprintf("%d bytes forward, %d bytes back in %s", s.AToB, s.BToA, s.Duration.Round(time.Millisecond))
+	if s.Err != nil {
+		text += ", " + s.Err.Error()
+	}
+	return text
+}
+
+// LogValue groups the summary's fields in structured logs
+func (s PipeSummary) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Int64("bytes_forward", s.AToB),
+		slog.Int64("bytes_back", s.BToA),
+		slog.Duration("duration", s.Duration),
+	}
+	if s.Err != nil {
+		attrs = append(attrs, slog.String("err", s.Err.Error()))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+var (
+	ErrIdleTimeout = errors.New("idle timeout")
+	ErrPipeTimeout = errors.New("pipe timeout")
+)
+
+// Pipe copies between a and b in both directions until both are done, then
+// closes them. When one side finishes sending, the other side's sending
+// direction is closed with CloseWrite, so its peer reads EOF and can still
+// answer. Connections without CloseWrite, like smux streams of receivers
+// that did not agree on WithHalfClose, are closed right away instead, as
+// their peer would never learn that the data ended. Between two TCP
+// connections the bytes are spliced in the kernel.
+func Pipe(a, b net.Conn, timeouts PipeTimeouts) PipeSummary {
+	start := time.Now()
+	var aToB, bToA atomic.Int64
+	errs := make(chan error, 2)
+	copyHalf := func(dst, src net.Conn, progress *atomic.Int64) {
+		_, err := splice.Copy(dst, src, progress)
+		if err == nil {
+			// All data went through, a peer that is gone already does not
+			// miss the half-close
+			if err = closeWrite(dst); !errors.Is(err, errors.ErrUnsupported) {
+				err = nil
+			}
+		}
+		errs <- err
+	}
+	go copyHalf(b, a, &aToB)
+	go copyHalf(a, b, &bToA)
+
+	var summary PipeSummary
+	closed := false
+	hangUp := func(reason error) {
+		if !closed {
+			closed = true
+			summary.Err = reason
+			a.Close()
+			b.Close()
+		}
+	}
+
+	var deadline <-chan time.Time
+	if timeouts.Total > 0 {
+		timer := time.NewTimer(timeouts.Total)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	// Idleness is checked a few times per timeout, so it is detected at
+	// most a quarter late
+	var idleCheck <-chan time.Time
+	if timeouts.Idle > 0 {
+		ticker := time.NewTicker(timeouts.Idle / 4)
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+	lastCount, lastActive := int64(0), start
+
+	for running := 2; running > 0; {
+		select {
+		case err := <-errs:
+			running--
+			if errors.Is(err, errors.ErrUnsupported) {
+				hangUp(nil)
+			} else if err != nil {
+				hangUp(err)
+			}
+		case <-deadline:
+			hangUp(ErrPipeTimeout)
+		case now := <-idleCheck:
+			if count := aToB.Load() + bToA.Load(); count != lastCount {
+				lastCount, lastActive = count, now
+			} else if now.Sub(lastActive) >= timeouts.Idle {
+				hangUp(ErrIdleTimeout)
+			}
+		}
+	}
+	hangUp(summary.Err)
+
+	summary.AToB = aToB.Load()
+	summary.BToA = bToA.Load()
+	summary.Duration = time.Since(start)
+	return summary
+}
+
+// closeWrite ends the sending direction of conn, errors.ErrUnsupported
+// when it cannot
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DialTCP connects to addr, tunnelling through the HTTPS_PROXY of the
+// environment with CONNECT if one applies to addr
+func DialTCP(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy settings: %w", err)
+	}
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	conn, err := dialProxy(ctx, dialer, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := connect(ctx, conn, proxyURL, addr, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func dialProxy(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL) (net.Conn, error) {
+	host := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyURL.Scheme == "https" {
+		conn, err = (&tls.Dialer{NetDialer: dialer}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("proxy connection failed: %w", err)
+	}
+	return conn, nil
+}
+
+// connect asks the proxy on conn to open a tunnel to addr
+func connect(ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		delete(req.Header, "Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("proxy CONNECT failed: %w", err)
+	}
+
+	// The relay does not speak first, nothing can be buffered past the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("proxy CONNECT failed: %w", err)
+	}
+	// The body of a successful CONNECT is the tunnel, it is not closed here
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+	return nil
+}
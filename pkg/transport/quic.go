@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICALPN is the ALPN protocol of the relay's QUIC receiver port
+const QUICALPN = "bie"
+
+// QUICConfig keeps registrations alive like smux does, and lets a receiver
+// keep its connection while its address changes, e.g. switching Wi-Fi
+var QUICConfig = &quic.Config{
+	MaxIdleTimeout:     30 * time.Second,
+	KeepAlivePeriod:    10 * time.Second,
+	MaxIncomingStreams: 1024,
+}
+
+// DialQUIC connects to the relay's QUIC receiver port at addr
+func DialQUIC(ctx context.Context, addr string, tlsConfig *tls.Config, timeout time.Duration) (Session, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{QUICALPN}
+
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := quic.DialAddr(dialCtx, addr, tlsConfig, QUICConfig)
+	if err != nil {
+		return nil, fmt.Errorf("QUIC connection failed: %w", err)
+	}
+	return QUICSession(conn), nil
+}
+
+// QUICSession adapts a QUIC connection to Session
+func QUICSession(conn *quic.Conn) Session {
+	return &quicSession{conn: conn}
+}
+
+type quicSession struct {
+	conn *quic.Conn
+	// Streams closed locally and waiting for the peer to close its side
+	closing sync.WaitGroup
+}
+
+func (s *quicSession) OpenStream() (net.Conn, error) {
+	stream, err := s.conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: stream, session: s}, nil
+}
+
+func (s *quicSession) AcceptStream() (net.Conn, error) {
+	stream, err := s.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: stream, session: s}, nil
+}
+
+func (s *quicSession) IsClosed() bool {
+	return s.conn.Context().Err() != nil
+}
+
+func (s *quicSession) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicSession) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close waits for closing streams to be done before closing the connection,
+// which discards data the peer has not acknowledged yet
+func (s *quicSession) Close() error {
+	done := make(chan struct{})
+	go func() {
+		s.closing.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(streamLinger):
+	}
+	return s.conn.CloseWithError(0, "")
+}
+
+// How long a closed stream keeps reading until the peer closed its side too.
+// Cancelling reads right away makes the peer's writes fail, which can cut
+// off data still flowing the other way.
+const streamLinger = 5 * time.Second
+
+// quicStream is a QUIC stream as a net.Conn. Close ends both directions,
+// like closing a TCP connection.
+type quicStream struct {
+	*quic.Stream
+	session *quicSession
+	once    sync.Once
+}
+
+func (s *quicStream) Close() error {
+	err := s.Stream.Close()
+	s.once.Do(func() {
+		s.session.closing.Add(1)
+		s.Stream.SetReadDeadline(time.Now().Add(streamLinger))
+		go func() {
+			defer s.session.closing.Done()
+			io.Copy(io.Discard, s.Stream)
+			s.Stream.CancelRead(0)
+		}()
+	})
+	return err
+}
+
+// Read returns io.EOF once the peer closed the whole connection without an
+// error, like bie does when it is done, rather than quic's error for it
+func (s *quicStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// CloseWrite ends the sending direction only, the peer's reads return
+// io.EOF while we keep reading
+func (s *quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
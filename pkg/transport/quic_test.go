@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// TestQUICLoopback runs a relay's QUIC receiver port and a receiver over
+// 127.0.0.1 UDP: the receiver sends its request on a stream of its own, the
+// relay opens a stream per sender, half-closes pass both ways and the
+// receiver hanging up reads as io.EOF.
+func TestQUICLoopback(t *testing.T) {
+	serverTLS, clientTLS := loopbackTLS(t, "relay.bie.test")
+	serverTLS.NextProtos = []string{QUICALPN}
+
+	listener, err := quic.ListenAddr("127.0.0.1:0", serverTLS, QUICConfig)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	relayErr := make(chan error, 1)
+	waiting := make(chan struct{})
+	go func() { relayErr <- serveLoopbackRelay(ctx, listener, waiting) }()
+
+	receiver, err := DialQUIC(ctx, listener.Addr().String(), clientTLS, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	// Request and answer, like the registration
+	request, err := receiver.OpenStream()
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	if _, err := request.Write([]byte("register")); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	request.(interface{ CloseWrite() error }).CloseWrite()
+	if answer, err := io.ReadAll(request); err != nil || string(answer) != "token" {
+		t.Fatalf("answer %q, %v; want token", answer, err)
+	}
+	request.Close()
+
+	// A sender arrives: its bytes until its half-close, then our answer
+	sender, err := receiver.AcceptStream()
+	if err != nil {
+		t.Fatalf("accept stream: %v", err)
+	}
+	if upload, err := io.ReadAll(sender); err != nil || string(upload) != "upload" {
+		t.Fatalf("upload %q, %v; want upload", upload, err)
+	}
+	if _, err := sender.Write([]byte("done")); err != nil {
+		t.Fatalf("write answer: %v", err)
+	}
+	sender.Close()
+
+	select {
+	case <-waiting:
+	case err := <-relayErr:
+		t.Fatalf("relay: %v", err)
+	}
+	if err := receiver.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := <-relayErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveLoopbackRelay plays the relay's side of TestQUICLoopback, waiting is
+// closed once it waits for the receiver to hang up
+func serveLoopbackRelay(ctx context.Context, listener *quic.Listener, waiting chan<- struct{}) error {
+	conn, err := listener.Accept(ctx)
+	if err != nil {
+		return err
+	}
+	session := QUICSession(conn)
+	defer session.Close()
+	if session.RemoteAddr().(*net.UDPAddr).IP.String() != "127.0.0.1" {
+		return errors.New("receiver not on loopback")
+	}
+
+	request, err := session.AcceptStream()
+	if err != nil {
+		return err
+	}
+	if data, err := io.ReadAll(request); err != nil || string(data) != "register" {
+		return errors.New("relay got no request")
+	}
+	request.Write([]byte("token"))
+	request.Close()
+
+	sender, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	sender.Write([]byte("upload"))
+	sender.(interface{ CloseWrite() error }).CloseWrite()
+	if answer, err := io.ReadAll(sender); err != nil || string(answer) != "done" {
+		return errors.New("relay got no answer after its half-close")
+	}
+
+	// The receiver hangs up without an error
+	idle, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	idle.Write([]byte{0})
+	close(waiting)
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		return fmt.Errorf("receiver hanging up read as %v, want io.EOF", err)
+	}
+	return nil
+}
+
+// loopbackTLS returns TLS configs of a server with a self-signed certificate
+// for name and of a client trusting it
+func loopbackTLS(t *testing.T, name string) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}}}
+	client := &tls.Config{RootCAs: roots, ServerName: name}
+	return server, client
+}
@@ -0,0 +1,35 @@
+package transport
+
+import (
+	"net"
+
+	"github.com/xtaci/smux"
+)
+
+// Session is a multiplexed connection between receiver and relay, either
+// smux over a stream transport or native QUIC streams
+type Session interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	IsClosed() bool
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// SmuxSession adapts a smux session to Session
+func SmuxSession(s *smux.Session) Session {
+	return smuxSession{s}
+}
+
+type smuxSession struct {
+	*smux.Session
+}
+
+func (s smuxSession) OpenStream() (net.Conn, error) {
+	return s.Session.OpenStream()
+}
+
+func (s smuxSession) AcceptStream() (net.Conn, error) {
+	return s.Session.AcceptStream()
+}
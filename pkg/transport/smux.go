@@ -0,0 +1,185 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"bie/pkg/biewire"
+
+	"github.com/xtaci/smux"
+)
+
+// Sent by receivers before their smux session to negotiate SmuxParams.
+// smux frames start with the protocol version, so the relay tells the two
+// apart and keeps serving receivers that do not negotiate.
+var smuxPreface = []byte("BIE-SMUX")
+
+// SmuxParams tune the smux session over the TLS and WebSocket transports.
+// Zero fields leave the choice to the other end, or to smux's defaults.
+type SmuxParams struct {
+	// Protocol version, 2 adds per-stream flow control
+	Version int `json:"version,omitempty"`
+	// Bytes buffered for the whole session before the reader is blocked
+	MaxReceiveBuffer int `json:"max_receive_buffer,omitempty"`
+	// Per-stream window of version 2, it bounds a stream's throughput to
+	// window / round trip time
+	MaxStreamBuffer int `json:"max_stream_buffer,omitempty"`
+	// Largest frame, at most 65535
+	MaxFrameSize int `json:"max_frame_size,omitempty"`
+	// Interval between keepalives, the session dies after three missed ones
+	KeepAliveInterval time.Duration `json:"keepalive_interval,omitempty"`
+}
+
+// IsZero reports whether p asks for nothing, such receivers skip the
+// negotiation and run smux's defaults
+func (p SmuxParams) IsZero() bool {
+	return p == SmuxParams{}
+}
+
+// Negotiate returns the parameters both ends of a session use: the lower of
+// p and peer's, and p's where peer left the choice to us
+func (p SmuxParams) Negotiate(peer SmuxParams) SmuxParams {
+	p = p.withDefaults()
+	return SmuxParams{
+		Version:           lowest(p.Version, peer.Version),
+		MaxReceiveBuffer:  lowest(p.MaxReceiveBuffer, peer.MaxReceiveBuffer),
+		MaxStreamBuffer:   lowest(p.MaxStreamBuffer, peer.MaxStreamBuffer),
+		MaxFrameSize:      lowest(p.MaxFrameSize, peer.MaxFrameSize),
+		KeepAliveInterval: lowest(p.KeepAliveInterval, peer.KeepAliveInterval),
+	}
+}
+
+func lowest[T int | time.Duration](own, peer T) T {
+	if peer > 0 && peer < own {
+		return peer
+	}
+	return own
+}
+
+func (p SmuxParams) withDefaults() SmuxParams {
+	defaults := smux.DefaultConfig()
+	if p.Version == 0 {
+		p.Version = defaults.Version
+	}
+	if p.MaxReceiveBuffer == 0 {
+		p.MaxReceiveBuffer = defaults.MaxReceiveBuffer
+	}
+	if p.MaxStreamBuffer == 0 {
+		p.MaxStreamBuffer = defaults.MaxStreamBuffer
+	}
+	if p.MaxFrameSize == 0 {
+		p.MaxFrameSize = defaults.MaxFrameSize
+	}
+	if p.KeepAliveInterval == 0 {
+		p.KeepAliveInterval = defaults.KeepAliveInterval
+	}
+	return p
+}
+
+// Config returns the smux configuration of p, with smux's defaults for zero
+// fields
+func (p SmuxParams) Config() (*smux.Config, error) {
+	p = p.withDefaults()
+	config := smux.DefaultConfig()
+	config.Version = p.Version
+	config.MaxReceiveBuffer = p.MaxReceiveBuffer
+	// A stream cannot buffer more than its session
+	config.MaxStreamBuffer = min(p.MaxStreamBuffer, p.MaxReceiveBuffer)
+	config.MaxFrameSize = p.MaxFrameSize
+	config.KeepAliveInterval = p.KeepAliveInterval
+	config.KeepAliveTimeout = 3 * p.KeepAliveInterval
+	if err := smux.VerifyConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid smux parameters: %w", err)
+	}
+	return config, nil
+}
+
+// SmuxClient starts the receiver's smux session over conn. Unless params
+// is zero, they are negotiated with the relay first.
+func SmuxClient(conn net.Conn, params SmuxParams) (Session, error) {
+	if params.IsZero() {
+		session, err := smux.Client(conn, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create smux session: %w", err)
+		}
+		return SmuxSession(session), nil
+	}
+	if _, err := params.Config(); err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(sniffTimeout))
+	if _, err := conn.Write(smuxPreface); err != nil {
+		return nil, fmt.Errorf("failed to send smux parameters: %w", err)
+	}
+	if err := biewire.SendJSON(conn, params); err != nil {
+		return nil, fmt.Errorf("failed to send smux parameters: %w", err)
+	}
+	var negotiated SmuxParams
+	if err := biewire.ReceiveJSON(conn, &negotiated); err != nil {
+		return nil, fmt.Errorf("relay did not negotiate smux parameters: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	config, err := negotiated.Config()
+	if err != nil {
+		return nil, err
+	}
+	session, err := smux.Client(conn, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create smux session: %w", err)
+	}
+	return SmuxSession(session), nil
+}
+
+// SmuxServer starts the relay's smux session over conn. Receivers that
+// negotiate get params capped by what they asked for, the others params
+// with smux's version 1, which is all they speak.
+func SmuxServer(conn net.Conn, params SmuxParams) (Session, error) {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	reader := bufio.NewReader(conn)
+	head, err := reader.Peek(len(smuxPreface))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn = &peekedConn{Conn: conn, reader: reader}
+
+	if !bytes.Equal(head, smuxPreface) {
+		params.Version = 1
+		config, err := params.Config()
+		if err != nil {
+			return nil, err
+		}
+		session, err := smux.Server(conn, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create smux session: %w", err)
+		}
+		return SmuxSession(session), nil
+	}
+
+	reader.Discard(len(smuxPreface))
+	conn.SetDeadline(time.Now().Add(sniffTimeout))
+	var requested SmuxParams
+	if err := biewire.ReceiveJSON(conn, &requested); err != nil {
+		return nil, fmt.Errorf("failed to read smux parameters: %w", err)
+	}
+	negotiated := params.Negotiate(requested)
+	config, err := negotiated.Config()
+	if err != nil {
+		return nil, err
+	}
+	if err := biewire.SendJSON(conn, negotiated); err != nil {
+		return nil, fmt.Errorf("failed to send smux parameters: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	session, err := smux.Server(conn, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create smux session: %w", err)
+	}
+	return SmuxSession(session), nil
+}
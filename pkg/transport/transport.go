@@ -0,0 +1,60 @@
+// Package transport carries the receiver's session to the relay, over QUIC
+// or over transports that get through restrictive networks
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Transports between receiver and relay
+const (
+	// TLS over TCP, through HTTPS_PROXY with CONNECT if one is set
+	TLS = "tls"
+	// WebSocket over TLS, through HTTPS_PROXY if one is set
+	WebSocket = "websocket"
+	// QUIC on the receiver port over UDP, with native streams
+	QUIC = "quic"
+	// QUIC, falling back to TLS when UDP does not get through
+	Auto = "auto"
+)
+
+// Check returns an error for unknown transport names
+func Check(name string) error {
+	switch name {
+	case TLS, WebSocket, QUIC, Auto:
+		return nil
+	default:
+		return fmt.Errorf("unknown transport %q", name)
+	}
+}
+
+// How long a receiver may take to send its first bytes
+const sniffTimeout = 30 * time.Second
+
+// SniffHTTP peeks at the first bytes of conn to tell HTTP requests, such as
+// WebSocket upgrades, from smux sessions. The returned connection still
+// yields the peeked bytes.
+func SniffHTTP(conn net.Conn) (net.Conn, bool, error) {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	head, err := reader.Peek(4)
+	if err != nil {
+		return nil, false, err
+	}
+	return &peekedConn{Conn: conn, reader: reader}, bytes.Equal(head, []byte("GET ")), nil
+}
+
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
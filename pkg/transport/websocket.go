@@ -0,0 +1,58 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// WebSocket endpoint and subprotocol of the relay's receiver listener
+const (
+	WebSocketPath        = "/smux"
+	WebSocketSubprotocol = "bie-smux"
+)
+
+// DialWebSocket connects to the relay's WebSocket endpoint at addr and
+// returns the binary message stream as a connection to run smux over.
+// HTTPS_PROXY is honoured.
+func DialWebSocket(ctx context.Context, addr string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			DialContext:     (&net.Dialer{Timeout: timeout}).DialContext,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	conn, _, err := websocket.Dial(dialCtx, "wss://"+addr+WebSocketPath, &websocket.DialOptions{
+		HTTPClient:   client,
+		Subprotocols: []string{WebSocketSubprotocol},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket connection failed: %w", err)
+	}
+	return websocket.NetConn(context.Background(), conn, websocket.MessageBinary), nil
+}
+
+// WebSocketHandler upgrades requests to WebSocketPath and hands the message
+// stream to serve, which owns it until it returns
+func WebSocketHandler(serve func(net.Conn)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+WebSocketPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{WebSocketSubprotocol},
+		})
+		if err != nil {
+			return
+		}
+		serve(websocket.NetConn(context.Background(), conn, websocket.MessageBinary))
+	})
+	return mux
+}